@@ -0,0 +1,7 @@
+ALTER TABLE ledger
+ADD COLUMN actor_id INT REFERENCES users(id), -- admin who made the adjustment
+ADD COLUMN previous_amount FLOAT,              -- balance before the adjustment
+ADD COLUMN reason TEXT;
+
+INSERT INTO schema_migrations (version)
+VALUES (11);
@@ -0,0 +1,5 @@
+ALTER TABLE users
+ADD COLUMN deleted_at TIMESTAMP; -- set when the user is merged into another one
+
+INSERT INTO schema_migrations (version)
+VALUES (12);
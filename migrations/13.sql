@@ -0,0 +1,10 @@
+CREATE TABLE balance_snapshots (
+    snapshot_date DATE NOT NULL,
+    user_id INT REFERENCES users(id) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    amount FLOAT NOT NULL,
+    PRIMARY KEY (user_id, currency, snapshot_date)
+);
+
+INSERT INTO schema_migrations (version)
+VALUES (13);
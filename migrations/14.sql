@@ -0,0 +1,7 @@
+ALTER TABLE ledger
+ADD COLUMN batch_id INT REFERENCES ledger(id) ON DELETE SET NULL; -- first entry of the batch this one belongs to
+
+CREATE INDEX ledger_batch_id_idx ON ledger (batch_id);
+
+INSERT INTO schema_migrations (version)
+VALUES (14);
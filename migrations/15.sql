@@ -0,0 +1,5 @@
+ALTER TABLE currencies
+ADD COLUMN min_balance FLOAT NOT NULL DEFAULT 0 CHECK (min_balance >= 0); -- the least amount a seller may keep after a transfer
+
+INSERT INTO schema_migrations (version)
+VALUES (15);
@@ -0,0 +1,5 @@
+ALTER TABLE currencies
+ADD COLUMN trading_halted BOOLEAN NOT NULL DEFAULT FALSE;
+
+INSERT INTO schema_migrations (version)
+VALUES (16);
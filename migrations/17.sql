@@ -0,0 +1,16 @@
+CREATE TABLE currency_history (
+    id SERIAL PRIMARY KEY,
+    currency VARCHAR(10) NOT NULL,
+    value FLOAT NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX currency_history_currency_changed_at_idx ON currency_history (currency, changed_at);
+CREATE INDEX ledger_created_at_idx ON ledger (created_at);
+
+INSERT INTO currency_history (currency, value)
+SELECT currency, value
+FROM currencies;
+
+INSERT INTO schema_migrations (version)
+VALUES (17);
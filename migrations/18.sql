@@ -0,0 +1,5 @@
+ALTER TABLE users
+ADD COLUMN treasury BOOLEAN NOT NULL DEFAULT FALSE; -- account of the exchange itself
+
+INSERT INTO schema_migrations (version)
+VALUES (18);
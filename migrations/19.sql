@@ -0,0 +1,5 @@
+ALTER TABLE ledger
+ADD COLUMN price FLOAT; -- value of the currency at the moment of the transfer
+
+INSERT INTO schema_migrations (version)
+VALUES (19);
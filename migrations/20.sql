@@ -0,0 +1,5 @@
+ALTER TABLE users_money
+ADD COLUMN reserved FLOAT NOT NULL DEFAULT 0 CHECK (reserved >= 0); -- part of the amount locked by open orders
+
+INSERT INTO schema_migrations (version)
+VALUES (20);
@@ -0,0 +1,13 @@
+CREATE TABLE currency_stats (
+    currency VARCHAR(255) PRIMARY KEY,
+    total_volume FLOAT NOT NULL DEFAULT 0 -- sum of all traded amounts, kept in sync by the trade transactions
+);
+
+INSERT INTO currency_stats (currency, total_volume)
+SELECT currency, SUM(amount)
+FROM ledger
+WHERE operation = 'trade'
+GROUP BY currency;
+
+INSERT INTO schema_migrations (version)
+VALUES (21);
@@ -0,0 +1,6 @@
+ALTER TABLE currency_history
+ADD COLUMN admin_id INT REFERENCES users(id), -- admin who changed the value, NULL for unaudited changes
+ADD COLUMN reason TEXT;
+
+INSERT INTO schema_migrations (version)
+VALUES (22);
@@ -0,0 +1,8 @@
+ALTER TABLE users
+DROP CONSTRAINT users_email_key;
+
+-- emails of merged (soft-deleted) users can be registered again
+CREATE UNIQUE INDEX users_email_active_idx ON users (email) WHERE deleted_at IS NULL;
+
+INSERT INTO schema_migrations (version)
+VALUES (23);
@@ -0,0 +1,12 @@
+CREATE TABLE ledger (
+    id SERIAL PRIMARY KEY,
+    operation VARCHAR(32) NOT NULL,
+    seller_id INT REFERENCES users(id), -- NULL when the money comes from outside of the exchange
+    buyer_id INT REFERENCES users(id),  -- NULL when the money leaves the exchange
+    currency VARCHAR(255) NOT NULL,
+    amount FLOAT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX ledger_seller_id_idx ON ledger (seller_id, created_at);
+CREATE INDEX ledger_buyer_id_idx ON ledger (buyer_id, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE currencies
+ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+CREATE TABLE login_events (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id) NOT NULL,
+    ip VARCHAR(45),
+    success BOOLEAN NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX login_events_user_id_created_at_idx ON login_events (user_id, created_at);
@@ -0,0 +1,4 @@
+ALTER TABLE ledger
+ADD COLUMN reference_id INT REFERENCES ledger(id) ON DELETE SET NULL; -- entry this one reverses
+
+CREATE UNIQUE INDEX ledger_refund_reference_id_idx ON ledger (reference_id) WHERE operation = 'refund';
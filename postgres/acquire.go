@@ -0,0 +1,163 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// timeoutPool waits for a free connection of the pool no longer than timeout
+// and fails with ErrPoolExhausted instead of blocking until one is released.
+type timeoutPool struct {
+	pool    *pgxpool.Pool
+	timeout time.Duration
+}
+
+// withAcquireTimeout returns the pool itself if timeout is not positive
+func withAcquireTimeout(pool *pgxpool.Pool, timeout time.Duration) querier {
+	if timeout <= 0 {
+		return pool
+	}
+
+	return &timeoutPool{pool: pool, timeout: timeout}
+}
+
+func (tp *timeoutPool) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	acquireCtx, cancel := context.WithTimeout(ctx, tp.timeout)
+	defer cancel()
+
+	conn, err := tp.pool.Acquire(acquireCtx)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(acquireCtx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w; no connection was released within %v", ErrPoolExhausted, tp.timeout)
+		}
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (tp *timeoutPool) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	conn, err := tp.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Release()
+
+	return conn.Exec(ctx, sql, args...)
+}
+
+func (tp *timeoutPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	conn, err := tp.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	return &releasingRows{Rows: rows, conn: conn}, nil
+}
+
+func (tp *timeoutPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	conn, err := tp.acquire(ctx)
+	if err != nil {
+		return errRow{err}
+	}
+
+	return releasingRow{row: conn.QueryRow(ctx, sql, args...), conn: conn}
+}
+
+func (tp *timeoutPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	return tp.BeginTx(ctx, pgx.TxOptions{})
+}
+
+func (tp *timeoutPool) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	conn, err := tp.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := conn.BeginTx(ctx, txOptions)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	return &releasingTx{Tx: tx, conn: conn}, nil
+}
+
+// releasingRows releases the connection once the rows are read or closed
+type releasingRows struct {
+	pgx.Rows
+	conn *pgxpool.Conn
+}
+
+func (rr *releasingRows) Next() bool {
+	if rr.Rows.Next() {
+		return true
+	}
+
+	rr.release()
+
+	return false
+}
+
+func (rr *releasingRows) Close() {
+	rr.Rows.Close()
+	rr.release()
+}
+
+func (rr *releasingRows) release() {
+	if rr.conn != nil {
+		rr.conn.Release()
+		rr.conn = nil
+	}
+}
+
+// releasingRow releases the connection once the row is scanned
+type releasingRow struct {
+	row  pgx.Row
+	conn *pgxpool.Conn
+}
+
+func (rr releasingRow) Scan(dest ...interface{}) error {
+	defer rr.conn.Release()
+
+	return rr.row.Scan(dest...)
+}
+
+// releasingTx releases the connection once the transaction is committed or rolled back
+type releasingTx struct {
+	pgx.Tx
+	conn *pgxpool.Conn
+}
+
+func (rt *releasingTx) Commit(ctx context.Context) error {
+	defer rt.release()
+
+	return rt.Tx.Commit(ctx)
+}
+
+func (rt *releasingTx) Rollback(ctx context.Context) error {
+	defer rt.release()
+
+	return rt.Tx.Rollback(ctx)
+}
+
+func (rt *releasingTx) release() {
+	if rt.conn != nil {
+		rt.conn.Release()
+		rt.conn = nil
+	}
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"sync"
+	"time"
+)
+
+// currencyCache keeps the result of GetCurrencies in memory for ttl, separately for every tenant.
+// It trades freshness for throughput: rates changed by another process
+// become visible only after the cached value expires.
+// Every invalidate starts a new generation of the tenant; values read from the database before it
+// are not cached, so a fill racing with an update cannot bring the old rates back.
+type currencyCache struct {
+	mu          sync.RWMutex
+	ttl         time.Duration
+	entries     map[string]cachedCurrencies
+	generations map[string]uint64
+}
+
+type cachedCurrencies struct {
+	values    map[string]float64
+	expiresAt time.Time
+}
+
+func newCurrencyCache(ttl time.Duration) *currencyCache {
+	return &currencyCache{
+		ttl:         ttl,
+		entries:     make(map[string]cachedCurrencies),
+		generations: make(map[string]uint64),
+	}
+}
+
+func (cc *currencyCache) get(tenant string) (map[string]float64, bool) {
+	if cc.ttl <= 0 {
+		return nil, false
+	}
+
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	entry, ok := cc.entries[tenant]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	return copyCurrencies(entry.values), true
+}
+
+// currentGeneration must be taken before reading the values that are later passed to set
+func (cc *currencyCache) currentGeneration(tenant string) uint64 {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return cc.generations[tenant]
+}
+
+// set caches the values read during the generation; they are dropped if the tenant's cache was invalidated since
+func (cc *currencyCache) set(tenant string, values map[string]float64, generation uint64) {
+	if cc.ttl <= 0 {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if generation != cc.generations[tenant] {
+		return
+	}
+
+	cc.entries[tenant] = cachedCurrencies{
+		values:    copyCurrencies(values),
+		expiresAt: time.Now().Add(cc.ttl),
+	}
+}
+
+func (cc *currencyCache) invalidate(tenant string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	delete(cc.entries, tenant)
+	cc.generations[tenant]++
+}
+
+func copyCurrencies(values map[string]float64) map[string]float64 {
+	res := make(map[string]float64, len(values))
+	for currency, value := range values {
+		res[currency] = value
+	}
+
+	return res
+}
@@ -0,0 +1,85 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurrencyCache(t *testing.T) {
+	rates := map[string]float64{"USD": 1, "EUR": 1.01}
+
+	t.Run("disabled without ttl", func(t *testing.T) {
+		cc := newCurrencyCache(0)
+		cc.set("", rates, cc.currentGeneration(""))
+
+		if _, ok := cc.get(""); ok {
+			t.Fatal("cache without ttl returned values")
+		}
+	})
+
+	t.Run("returns a copy of the cached values", func(t *testing.T) {
+		cc := newCurrencyCache(time.Minute)
+		cc.set("", rates, cc.currentGeneration(""))
+
+		cached, ok := cc.get("")
+		if !ok || cached["EUR"] != 1.01 {
+			t.Fatalf("got %v, %v; want cached rates", cached, ok)
+		}
+
+		cached["EUR"] = 2
+		if again, _ := cc.get(""); again["EUR"] != 1.01 {
+			t.Fatalf("changing the returned map changed the cache: %v", again)
+		}
+	})
+
+	t.Run("expires after ttl", func(t *testing.T) {
+		cc := newCurrencyCache(time.Millisecond)
+		cc.set("", rates, cc.currentGeneration(""))
+		time.Sleep(5 * time.Millisecond)
+
+		if _, ok := cc.get(""); ok {
+			t.Fatal("expired values returned")
+		}
+	})
+
+	t.Run("invalidate drops the values", func(t *testing.T) {
+		cc := newCurrencyCache(time.Minute)
+		cc.set("", rates, cc.currentGeneration(""))
+		cc.invalidate("")
+
+		if _, ok := cc.get(""); ok {
+			t.Fatal("invalidated values returned")
+		}
+	})
+
+	t.Run("values read before invalidate are not cached", func(t *testing.T) {
+		cc := newCurrencyCache(time.Minute)
+
+		generation := cc.currentGeneration("") // GetCurrencies starts reading the old rates
+		cc.invalidate("")                      // UpdateCurrency commits a new rate meanwhile
+		cc.set("", rates, generation)          // GetCurrencies finishes with the stale rates
+
+		if stale, ok := cc.get(""); ok {
+			t.Fatalf("stale values cached: %v", stale)
+		}
+
+		cc.set("", rates, cc.currentGeneration(""))
+		if _, ok := cc.get(""); !ok {
+			t.Fatal("values of the current generation are not cached")
+		}
+	})
+
+	t.Run("tenants are cached separately", func(t *testing.T) {
+		cc := newCurrencyCache(time.Minute)
+		cc.set("a", rates, cc.currentGeneration("a"))
+
+		if _, ok := cc.get("b"); ok {
+			t.Fatal("values of tenant a returned for tenant b")
+		}
+
+		cc.invalidate("b")
+		if _, ok := cc.get("a"); !ok {
+			t.Fatal("invalidating tenant b dropped the values of tenant a")
+		}
+	})
+}
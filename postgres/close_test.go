@@ -0,0 +1,31 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMethodsFailAfterClose(t *testing.T) {
+	closes := 0
+	pc := &postgresClient{close: func() { closes++ }}
+
+	pc.Close()
+	pc.Close()
+
+	if closes != 1 {
+		t.Fatalf("connection closed %v times, want 1", closes)
+	}
+
+	if _, err := pc.GetCurrencies(); !errors.Is(err, ErrHandlerClosed) {
+		t.Fatalf("GetCurrencies: got %v, want ErrHandlerClosed", err)
+	}
+
+	if err := pc.SendCurrency(1, 2, "USD", 1); !errors.Is(err, ErrHandlerClosed) {
+		t.Fatalf("SendCurrency: got %v, want ErrHandlerClosed", err)
+	}
+
+	if _, err := pc.GetCurrenciesNum(context.Background()); !errors.Is(err, ErrHandlerClosed) {
+		t.Fatalf("GetCurrenciesNum: got %v, want ErrHandlerClosed", err)
+	}
+}
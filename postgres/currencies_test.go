@@ -0,0 +1,401 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGetCurrenciesNum(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	before, err := pc.GetCurrenciesNum(ctx)
+	if err != nil {
+		t.Fatalf("GetCurrenciesNum: %v", err)
+	}
+
+	value := 2.5
+	err = pc.CreateCurrency(ctx, "TST", &value)
+	if err != nil {
+		t.Fatalf("CreateCurrency: %v", err)
+	}
+
+	after, err := pc.GetCurrenciesNum(ctx)
+	if err != nil {
+		t.Fatalf("GetCurrenciesNum: %v", err)
+	}
+
+	if after != before+1 {
+		t.Fatalf("got %v currencies after creating one, want %v", after, before+1)
+	}
+}
+
+func TestGetCurrenciesLenientSkipsNullRates(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	mustExec(t, pc, "ALTER TABLE currencies ALTER COLUMN value DROP NOT NULL")
+	mustExec(t, pc, "INSERT INTO currencies (currency, value) VALUES ('NUL', NULL)")
+
+	strict, err := pc.GetCurrencies()
+	if !errors.Is(err, ErrNullRate) {
+		t.Fatalf("GetCurrencies: got %v, %v; want ErrNullRate", strict, err)
+	}
+
+	currencies, err := pc.GetCurrenciesLenient(ctx)
+	if !errors.Is(err, ErrPartialResult) {
+		t.Fatalf("GetCurrenciesLenient: got %v, want ErrPartialResult", err)
+	}
+
+	if !strings.Contains(err.Error(), "NUL") {
+		t.Fatalf("error %q does not name the skipped currency", err)
+	}
+
+	if _, ok := currencies["NUL"]; ok {
+		t.Fatal("currency with NULL rate returned")
+	}
+
+	if currencies["USD"] != 1 || len(currencies) != 7 {
+		t.Fatalf("got %v, want the 7 seeded currencies", currencies)
+	}
+}
+
+func TestNormalizeCurrencyCodesKeepsAllColumns(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	userID := newTestUser(t, pc)
+
+	mustExec(t, pc, `INSERT INTO currencies (currency, value, version, min_balance, trading_halted) VALUES ('mix', 2, 3, 1, TRUE)`)
+	mustExec(t, pc, `INSERT INTO users_money (user_id, currency, amount, reserved) VALUES ($1, 'mix', 10, 2), ($1, 'Mix', 5, 1)`, userID)
+	mustExec(t, pc, `INSERT INTO currency_history (currency, value) VALUES ('mix', 2)`)
+	mustExec(t, pc, `INSERT INTO currency_stats (currency, total_volume) VALUES ('mix', 7), ('MIX', 3)`)
+	mustExec(t, pc, `INSERT INTO balance_snapshots (snapshot_date, user_id, currency, amount) VALUES ('2024-01-01', $1, 'mix', 4), ('2024-01-01', $1, 'MIX', 6)`, userID)
+
+	err := pc.NormalizeCurrencyCodes(ctx)
+	if err != nil {
+		t.Fatalf("NormalizeCurrencyCodes: %v", err)
+	}
+
+	var value, minBalance float64
+	var version int64
+	var halted bool
+	err = pc.connection.QueryRow(ctx, "SELECT value, version, min_balance, trading_halted FROM currencies WHERE currency = 'MIX'").
+		Scan(&value, &version, &minBalance, &halted)
+
+	if err != nil || value != 2 || version != 3 || minBalance != 1 || !halted {
+		t.Fatalf("currency: got value %v, version %v, min balance %v, halted %v, %v; want 2, 3, 1, true", value, version, minBalance, halted, err)
+	}
+
+	var amount, reserved float64
+	err = pc.connection.QueryRow(ctx, "SELECT amount, reserved FROM users_money WHERE user_id = $1 AND currency = 'MIX'", userID).
+		Scan(&amount, &reserved)
+
+	if err != nil || amount != 15 || reserved != 3 {
+		t.Fatalf("balance: got amount %v, reserved %v, %v; want 15, 3", amount, reserved, err)
+	}
+
+	volume, err := pc.GetCurrencyVolume(ctx, "MIX")
+	if err != nil || volume != 10 {
+		t.Fatalf("volume: got %v, %v; want 10", volume, err)
+	}
+
+	var snapshot float64
+	err = pc.connection.QueryRow(ctx, "SELECT amount FROM balance_snapshots WHERE user_id = $1 AND currency = 'MIX'", userID).Scan(&snapshot)
+	if err != nil || snapshot != 10 {
+		t.Fatalf("snapshot: got %v, %v; want 10", snapshot, err)
+	}
+
+	mixedCase := 0
+	err = pc.connection.QueryRow(
+		ctx,
+		`SELECT
+			(SELECT COUNT(*) FROM currencies WHERE currency <> UPPER(currency))
+			+ (SELECT COUNT(*) FROM users_money WHERE currency <> UPPER(currency))
+			+ (SELECT COUNT(*) FROM currency_history WHERE currency <> UPPER(currency))
+			+ (SELECT COUNT(*) FROM currency_stats WHERE currency <> UPPER(currency))
+			+ (SELECT COUNT(*) FROM balance_snapshots WHERE currency <> UPPER(currency))`,
+	).Scan(&mixedCase)
+
+	if err != nil || mixedCase != 0 {
+		t.Fatalf("got %v mixed-case rows left, %v; want 0", mixedCase, err)
+	}
+}
+
+func TestCreateCurrencyDefaultValue(t *testing.T) {
+	explicit := 2.5
+
+	tests := []struct {
+		name         string
+		defaultValue float64
+		value        *float64
+		want         float64
+	}{
+		{"unset default", 0, nil, 1},
+		{"configured default", 0.25, nil, 0.25},
+		{"explicit value", 0.25, &explicit, 2.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := newTestClient(t, PostgreSettings{DefaultCurrencyValue: tt.defaultValue})
+			ctx := context.Background()
+
+			err := pc.CreateCurrency(ctx, "new", tt.value)
+			if err != nil {
+				t.Fatalf("CreateCurrency: %v", err)
+			}
+
+			got, err := pc.GetCurrencyValue("NEW")
+			if err != nil {
+				t.Fatalf("GetCurrencyValue: %v", err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("value of the created currency = %v, want %v", got, tt.want)
+			}
+
+			err = pc.CreateCurrency(ctx, "NEW", nil)
+			if !errors.Is(err, ErrCurrencyExists) {
+				t.Fatalf("second CreateCurrency: got %v, want %v", err, ErrCurrencyExists)
+			}
+		})
+	}
+}
+
+func TestGetTotalCirculation(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	mustExec(t, pc, "DELETE FROM users_money")
+
+	total, err := pc.GetTotalCirculation(ctx)
+	if err != nil {
+		t.Fatalf("GetTotalCirculation: %v", err)
+	}
+
+	if total != 0 {
+		t.Fatalf("GetTotalCirculation() = %v without balances, want 0", total)
+	}
+
+	// every new user gets 1000 USD
+	first := newTestUser(t, pc)
+	newTestUser(t, pc)
+	mustExec(t, pc, "INSERT INTO users_money (user_id, currency, amount) VALUES ($1, 'EUR', 50.5), ($1, 'JPY', 0)", first)
+
+	total, err = pc.GetTotalCirculation(ctx)
+	if err != nil {
+		t.Fatalf("GetTotalCirculation: %v", err)
+	}
+
+	if total != 2050.5 {
+		t.Fatalf("GetTotalCirculation() = %v, want 2050.5", total)
+	}
+}
+
+func TestCountCurrenciesAboveValue(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	// the seeded currencies are worth far less than the threshold
+	for currency, value := range map[string]float64{"BLW": 999999, "EQL": 1000000, "ABV": 1000001} {
+		value := value
+		err := pc.CreateCurrency(ctx, currency, &value)
+		if err != nil {
+			t.Fatalf("CreateCurrency(%v): %v", currency, err)
+		}
+	}
+
+	tests := []struct {
+		minValue float64
+		want     int
+	}{
+		{999998, 3},
+		{999999, 3},
+		{999999.5, 2},
+		{1000000, 2},
+		{1000000.5, 1},
+		{1000001, 1},
+		{1000002, 0},
+	}
+
+	for _, tt := range tests {
+		got, err := pc.CountCurrenciesAboveValue(ctx, tt.minValue)
+		if err != nil {
+			t.Fatalf("CountCurrenciesAboveValue(%v): %v", tt.minValue, err)
+		}
+
+		if got != tt.want {
+			t.Errorf("CountCurrenciesAboveValue(%v) = %v, want %v", tt.minValue, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkCurrenciesWithSupply compares GetCurrenciesWithSupply with the GetCurrencies and
+// GetCurrencyAmount per currency it replaces; queries/op is the number of round-trips.
+func BenchmarkCurrenciesWithSupply(b *testing.B) {
+	pc := newTestClient(b, PostgreSettings{})
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		value := float64(i + 1)
+		err := pc.CreateCurrency(ctx, fmt.Sprintf("B%02d", i), &value)
+		if err != nil {
+			b.Fatalf("CreateCurrency: %v", err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		newTestUser(b, pc)
+	}
+
+	b.Run("GetCurrenciesWithSupply", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := pc.GetCurrenciesWithSupply(ctx)
+			if err != nil {
+				b.Fatalf("GetCurrenciesWithSupply: %v", err)
+			}
+		}
+
+		b.ReportMetric(1, "queries/op")
+	})
+
+	b.Run("GetCurrencies+GetCurrencyAmount", func(b *testing.B) {
+		queries := 0
+		for i := 0; i < b.N; i++ {
+			currencies, err := pc.GetCurrencies()
+			if err != nil {
+				b.Fatalf("GetCurrencies: %v", err)
+			}
+
+			for currency := range currencies {
+				_, err = pc.GetCurrencyAmount(currency)
+				if err != nil {
+					b.Fatalf("GetCurrencyAmount(%v): %v", currency, err)
+				}
+			}
+
+			queries += len(currencies) + 1
+		}
+
+		b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+	})
+}
+
+func TestEmptyCurrencies(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	// the migrations seed currencies and the admin's balances; remove them to get an empty exchange
+	mustExec(t, pc, "DELETE FROM users_money")
+	mustExec(t, pc, "DELETE FROM currencies")
+
+	currencies, err := pc.GetCurrencies()
+	if err != nil || len(currencies) != 0 {
+		t.Errorf("GetCurrencies() = %v, %v; want an empty map", currencies, err)
+	}
+
+	if num, err := pc.GetCurrenciesNum(ctx); err != nil || num != 0 {
+		t.Errorf("GetCurrenciesNum() = %v, %v; want 0", num, err)
+	}
+
+	if supply, err := pc.GetCurrenciesWithSupply(ctx); err != nil || len(supply) != 0 {
+		t.Errorf("GetCurrenciesWithSupply() = %v, %v; want no currencies", supply, err)
+	}
+
+	if amount, err := pc.GetCurrencyAmount("USD"); err != nil || amount != 0 {
+		t.Errorf("GetCurrencyAmount(USD) = %v, %v; want 0", amount, err)
+	}
+
+	if total, err := pc.GetTotalCirculation(ctx); err != nil || total != 0 {
+		t.Errorf("GetTotalCirculation() = %v, %v; want 0", total, err)
+	}
+
+	if count, err := pc.CountCurrenciesAboveValue(ctx, 0); err != nil || count != 0 {
+		t.Errorf("CountCurrenciesAboveValue(0) = %v, %v; want 0", count, err)
+	}
+
+	if _, err := pc.GetUsersNum(); err != nil {
+		t.Errorf("GetUsersNum: %v", err)
+	}
+
+	notFound := map[string]func() error{
+		"GetCurrencyValue": func() error {
+			_, err := pc.GetCurrencyValue("USD")
+			return err
+		},
+		"GetCurrencyWithVersion": func() error {
+			_, _, err := pc.GetCurrencyWithVersion(ctx, "USD")
+			return err
+		},
+		"UpdateCurrencyCAS": func() error {
+			return pc.UpdateCurrencyCAS(ctx, "USD", 2, 0)
+		},
+		"GetExchangeRate": func() error {
+			_, err := pc.GetExchangeRate(ctx, "USD", "EUR")
+			return err
+		},
+		"GetRateSpread": func() error {
+			_, _, _, _, err := pc.GetRateSpread(ctx)
+			return err
+		},
+	}
+
+	for name, call := range notFound {
+		if err := call(); !errors.Is(err, ErrCurrencyNotFound) {
+			t.Errorf("%v: got %v, want %v", name, err, ErrCurrencyNotFound)
+		}
+	}
+}
+
+func TestCreditAllHolders(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	holder := newTestUser(t, pc)
+	zero := newTestUser(t, pc)
+	negative := newTestUser(t, pc)
+	mustExec(t, pc, "UPDATE users_money SET amount = 0 WHERE user_id = $1 AND currency = 'USD'", zero)
+	mustExec(t, pc, "UPDATE users_money SET amount = -5 WHERE user_id = $1 AND currency = 'USD'", negative)
+
+	holders := 0
+	err := pc.connection.QueryRow(ctx, "SELECT COUNT(*) FROM users_money WHERE currency = 'USD' AND amount > 0").Scan(&holders)
+	if err != nil {
+		t.Fatalf("cannot count holders: %v", err)
+	}
+
+	for _, amount := range []float64{0, -1} {
+		_, err = pc.CreditAllHolders(ctx, "USD", amount)
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("CreditAllHolders(%v): got %v, want %v", amount, err, ErrInvalidArgument)
+		}
+	}
+
+	credited, err := pc.CreditAllHolders(ctx, "usd", 10)
+	if err != nil {
+		t.Fatalf("CreditAllHolders: %v", err)
+	}
+
+	if credited != holders {
+		t.Fatalf("CreditAllHolders() = %v, want %v", credited, holders)
+	}
+
+	tests := []struct {
+		name   string
+		userID uint64
+		want   float64
+	}{
+		{"holder", holder, 1010},
+		{"zero balance", zero, 0},
+		{"negative balance", negative, -5},
+	}
+
+	for _, tt := range tests {
+		if got := balance(t, pc, tt.userID, "USD"); got != tt.want {
+			t.Errorf("%v: balance = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
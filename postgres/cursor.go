@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// cursorBatchSize is how many rows are fetched from a server-side cursor at once
+const cursorBatchSize = 1000
+
+// streamCursor runs the query through a server-side cursor and calls handle for every row,
+// so only cursorBatchSize rows are held in memory at once. Iteration stops at the first error of handle,
+// which is returned as is. The cursor is closed before returning, so several streams may run in one transaction.
+func (pc *postgresClient) streamCursor(ctx context.Context, query string, args []interface{}, handle func(rows pgx.Rows) error) error {
+	tx, err := pc.connection.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	_, err = tx.Exec(ctx, "DECLARE stream NO SCROLL CURSOR FOR "+query, args...)
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot declare cursor; err: %v", err)
+	}
+
+	for {
+		rows, err := tx.Query(ctx, fmt.Sprintf("FETCH %d FROM stream", cursorBatchSize))
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot fetch from cursor; err: %v", err)
+		}
+
+		fetched := 0
+		for rows.Next() {
+			fetched++
+
+			err = handle(rows)
+			if err != nil {
+				rows.Close()
+				tx.Rollback(ctx)
+				return err
+			}
+		}
+
+		if rows.Err() != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot fetch from cursor; err: %v", rows.Err())
+		}
+
+		if fetched < cursorBatchSize {
+			break
+		}
+	}
+
+	// within WithReadOnlyTx or Begin tx is a savepoint, and releasing it keeps the cursor open
+	_, err = tx.Exec(ctx, "CLOSE stream")
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot close cursor; err: %v", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package postgres
+
+import "errors"
+
+var (
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrHandlerClosed   = errors.New("postgres handler is closed")
+	ErrPartialResult   = errors.New("some rows were skipped")
+	ErrRateLimited     = errors.New("too many requests")
+	ErrSchemaMismatch  = errors.New("database schema version does not match")
+	ErrPoolExhausted   = errors.New("no free database connection")
+	ErrTenantRequired  = errors.New("request has no tenant")
+
+	ErrVersionConflict  = errors.New("currency was modified concurrently")
+	ErrCurrencyNotFound = errors.New("currency does not exist")
+	ErrZeroRate         = errors.New("currency value is 0")
+	ErrNullRate         = errors.New("currency value is NULL")
+	ErrNoHistoricalRate = errors.New("no currency value recorded before the moment")
+	ErrRateExceeded     = errors.New("currency value exceeds the limit")
+	ErrCurrencyExists   = errors.New("currency already exists")
+
+	ErrUserNotFound    = errors.New("user does not exist")
+	ErrUserExists      = errors.New("user already exists")
+	ErrNoHoldings      = errors.New("user holds nothing")
+	ErrPasswordChanged = errors.New("password hash was changed concurrently")
+
+	ErrInsufficientFunds       = errors.New("insufficient funds")
+	ErrSelfTransfer            = errors.New("seller and buyer are the same user")
+	ErrDeadlockRetriesExceeded = errors.New("transfer deadlocked too many times")
+	ErrBelowMinimumBalance     = errors.New("balance would fall below the currency minimum")
+	ErrTradingHalted           = errors.New("trading of the currency is halted")
+	ErrTradeNotFound           = errors.New("trade does not exist")
+	ErrTradeAlreadyRefunded    = errors.New("trade was already refunded")
+	ErrNoTrades                = errors.New("user has no trades")
+)
@@ -0,0 +1,14 @@
+package postgres
+
+// operations that are stored in the ledger table
+const (
+	LedgerOperationTrade  = "trade"  // currency was sent from the seller to the buyer
+	LedgerOperationFee    = "fee"    // fee the seller paid to the fee account
+	LedgerOperationRecall = "recall" // currency was taken from the user by the exchange
+	LedgerOperationRefund = "refund" // trade referenced by reference_id was reversed
+	LedgerOperationCredit = "credit" // currency was given to the user by the exchange
+	LedgerOperationBonus  = "bonus"  // signup bonus of the new user
+	LedgerOperationWipe   = "wipe"   // balance of the user was zeroed by ZeroUserBalances
+	// admin set the balance of the user; amount is the difference between the new and previous_amount
+	LedgerOperationAdjustment = "adjustment"
+)
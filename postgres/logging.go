@@ -0,0 +1,43 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// correlationIDKey is the context key of the request's correlation id, see WithCorrelationID
+type correlationIDKey struct{}
+
+// CorrelationIDLogField is the field of the query log data that holds the correlation id
+const CorrelationIDLogField = "correlation_id"
+
+// WithCorrelationID returns a copy of ctx carrying the id; queries run with that context are logged with it
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation id stored in ctx by WithCorrelationID or an empty string
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// correlationLogger adds the correlation id of the query's context to every log line of the wrapped logger
+type correlationLogger struct {
+	logger pgx.Logger
+}
+
+func (cl correlationLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	if id := CorrelationID(ctx); id != "" {
+		withID := make(map[string]interface{}, len(data)+1)
+		for k, v := range data {
+			withID[k] = v
+		}
+
+		withID[CorrelationIDLogField] = id
+		data = withID
+	}
+
+	cl.logger.Log(ctx, level, msg, data)
+}
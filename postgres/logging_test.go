@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// recordingLogger keeps the data of the last logged line
+type recordingLogger struct {
+	level pgx.LogLevel
+	msg   string
+	data  map[string]interface{}
+}
+
+func (rl *recordingLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	rl.level = level
+	rl.msg = msg
+	rl.data = data
+}
+
+func TestCorrelationLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		data   map[string]interface{}
+		wantID string
+	}{
+		{name: "no correlation id", ctx: context.Background(), data: map[string]interface{}{"sql": "SELECT 1"}},
+		{name: "empty correlation id", ctx: WithCorrelationID(context.Background(), ""), data: map[string]interface{}{"sql": "SELECT 1"}},
+		{name: "correlation id", ctx: WithCorrelationID(context.Background(), "req-1"), data: map[string]interface{}{"sql": "SELECT 1"}, wantID: "req-1"},
+		{name: "correlation id and nil data", ctx: WithCorrelationID(context.Background(), "req-2"), wantID: "req-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &recordingLogger{}
+			logger := correlationLogger{logger: recorder}
+
+			inputLen := len(tt.data)
+			logger.Log(tt.ctx, pgx.LogLevelInfo, "Query", tt.data)
+
+			if recorder.level != pgx.LogLevelInfo || recorder.msg != "Query" {
+				t.Fatalf("logged %v %q, want %v %q", recorder.level, recorder.msg, pgx.LogLevelInfo, "Query")
+			}
+
+			for k, v := range tt.data {
+				if recorder.data[k] != v {
+					t.Fatalf("field %v = %v, want %v", k, recorder.data[k], v)
+				}
+			}
+
+			id, ok := recorder.data[CorrelationIDLogField]
+			if tt.wantID == "" {
+				if ok {
+					t.Fatalf("field %v = %v, want no field", CorrelationIDLogField, id)
+				}
+
+				return
+			}
+
+			if id != tt.wantID {
+				t.Fatalf("field %v = %v, want %v", CorrelationIDLogField, id, tt.wantID)
+			}
+
+			if len(tt.data) != inputLen {
+				t.Fatalf("the logged data was modified: %v", tt.data)
+			}
+		})
+	}
+}
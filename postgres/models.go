@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"fmt"
+	"time"
+)
+
+type User struct {
+	ID    uint64
+	Email string
+}
+
+type LoginEvent struct {
+	IP        string
+	Success   bool
+	CreatedAt time.Time
+}
+
+// TradeDirection tells whether a trade was sent or received by the user it was requested for
+type TradeDirection int
+
+const (
+	TradeDirectionAll TradeDirection = iota // not relative to any user
+	TradeDirectionSent
+	TradeDirectionReceived
+)
+
+type Trade struct {
+	ID        uint64
+	SellerID  uint64
+	BuyerID   uint64
+	Currency  string
+	Amount    float64
+	CreatedAt time.Time
+	Direction TradeDirection
+}
+
+// TradeFilter narrows down GetUserTrades; zero values of the fields do not filter anything
+type TradeFilter struct {
+	Currency  string
+	From      time.Time // inclusive
+	To        time.Time // exclusive
+	Direction TradeDirection
+	Limit     int
+	Offset    int
+}
+
+// ConnInfo describes the database the handler is connected to; it never contains the password
+type ConnInfo struct {
+	Host   string
+	Port   uint16
+	DbName string
+	User   string
+}
+
+func (ci ConnInfo) String() string {
+	return fmt.Sprintf("postgresql://%s:[REDACTED]@%s:%v/%s", ci.User, ci.Host, ci.Port, ci.DbName)
+}
+
+type PortfolioEntry struct {
+	Currency string
+	Amount   float64
+	Rate     float64
+	Value    float64 // Amount * Rate
+}
+
+type MarketCap struct {
+	Currency  string
+	Supply    float64 // total amount held by the users
+	Value     float64
+	MarketCap float64 // Supply * Value
+}
+
+type CurrencyInfo struct {
+	Currency string
+	Value    float64
+	Supply   float64 // total amount held by the users
+}
+
+// OrphanBalance is a users_money row whose currency is not in the currencies table
+type OrphanBalance struct {
+	UserID   uint64
+	Currency string
+	Amount   float64
+}
+
+type BalanceSnapshot struct {
+	Date   time.Time
+	Amount float64
+}
+
+type CurrencyPopularity struct {
+	Currency string
+	Holders  int
+}
+
+type Balance struct {
+	UserID   uint64
+	Currency string
+	Amount   float64
+}
+
+type HolderAmount struct {
+	UserID uint64
+	Amount float64
+}
+
+type CurrencyDetail struct {
+	Currency  string
+	Value     float64
+	Supply    float64 // total amount held by the users
+	Holders   int     // users holding a positive amount
+	Halted    bool
+	UpdatedAt time.Time // last change of the value; zero if it was never recorded
+}
+
+type CurrencyHistoryPoint struct {
+	Value     float64
+	ChangedAt time.Time
+}
+
+type VolumePoint struct {
+	Start  time.Time // beginning of the bucket
+	Volume float64
+}
+
+// ActivityEntry is a ledger entry that changed the balance of the user
+type ActivityEntry struct {
+	ID        uint64
+	Operation string // one of the LedgerOperation constants
+	Currency  string
+	Amount    float64 // negative if the balance of the user decreased
+	CreatedAt time.Time
+}
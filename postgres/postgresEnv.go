@@ -4,8 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 type PostgreSettings struct {
@@ -14,6 +19,50 @@ type PostgreSettings struct {
 	Host     string
 	Port     string
 	DbName   string
+	Schema   string // search_path of every pooled connection; empty keeps the server default
+
+	// CurrencyCacheTTL enables in-memory caching of GetCurrencies for the given duration; 0 disables the cache
+	CurrencyCacheTTL time.Duration
+
+	FeePercent   float64 // percent of the value SendCurrencyWithFee charges
+	FeeAccountID uint64  // user that receives the fees
+
+	// MaxConnLifetime and MaxConnIdleTime close pooled connections after the given duration; 0 keeps pgxpool defaults.
+	// Behind PgBouncer or a load balancer keep both below the proxy's own timeouts
+	// (e.g. server_lifetime and server_idle_timeout), 30m and 5m are reasonable starting values.
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+
+	// TenantResolver returns the tenant of the request; every tenant is routed to the database with the same name.
+	// Requests of an empty tenant fail with ErrTenantRequired, so the methods without a context
+	// (GetCurrencies, SendCurrency, ...) cannot be used with a resolver: use their context-taking counterparts.
+	// If TenantResolver is nil every request goes to the DbName database.
+	TenantResolver func(ctx context.Context) string
+
+	// SendCurrencyTxOptions are used for the transactions of SendCurrency and SendCurrencyWithFee;
+	// the zero value keeps the database default isolation level. Serialization failures and deadlocks are retried.
+	SendCurrencyTxOptions pgx.TxOptions
+
+	// AnonymousRecentTrades makes GetRecentTrades omit the seller and buyer ids
+	AnonymousRecentTrades bool
+
+	// RateLimiter is consulted before the expensive writes (transfers and registrations); nil disables limiting
+	RateLimiter RateLimiter
+
+	// AcquireTimeout bounds how long a call waits for a free connection when the pool is exhausted;
+	// the call fails with ErrPoolExhausted afterwards. 0 waits until the call's context is done.
+	AcquireTimeout time.Duration
+
+	// SignupBonus is credited to every user registered by RegisterUser: currency -> amount
+	SignupBonus map[string]float64
+
+	// DefaultCurrencyValue is the value of the currencies created without a known rate; 0 means 1.0
+	DefaultCurrencyValue float64
+
+	// Logger receives the query logs of LogLevel and above (0 keeps the pgx default, info); nil disables logging.
+	// Every line of a query whose context was made by WithCorrelationID has the CorrelationIDLogField field.
+	Logger   pgx.Logger
+	LogLevel pgx.LogLevel
 }
 
 type PostgresHandler interface {
@@ -28,56 +77,294 @@ type PostgresHandler interface {
 	GetUserMoney(userID uint64, currency string) (float64, error)
 	SendCurrency(sellerID, buyerID uint64, currency string, value float64) error
 	FindSeller(currency string, value float64) (uint64, error)
+	RecallCurrency(ctx context.Context, currency string) (int, error)
+	ListUsersAfter(ctx context.Context, afterID uint64, limit int) ([]User, error)
+	GetCurrencyWithVersion(ctx context.Context, currency string) (float64, int64, error)
+	UpdateCurrencyCAS(ctx context.Context, currency string, newValue float64, expectedVersion int64) error
+	GetTradeVolume(ctx context.Context, userID uint64, from, to time.Time) (map[string]float64, error)
+	GetAffordableCurrencies(ctx context.Context, userID uint64, baseCurrency string) ([]string, error)
+	// RecordLogin is not called by any method of the handler: the caller verifies the password
+	// (see GetAuthRecord) and has to record every sign-in attempt, successful or not.
+	RecordLogin(ctx context.Context, userID uint64, ip string, success bool) error
+	GetRecentLogins(ctx context.Context, userID uint64, limit int) ([]LoginEvent, error)
+	SendCurrencyWithFee(ctx context.Context, sellerID, buyerID uint64, currency string, value float64) error
+	FindDuplicateEmails(ctx context.Context) (map[string][]uint64, error)
+	GetCurrenciesNum(ctx context.Context) (int, error)
+	RefundTrade(ctx context.Context, tradeID uint64) error
+	GetExchangeRate(ctx context.Context, from, to string) (float64, error)
+	GetRecentTrades(ctx context.Context, limit int) ([]Trade, error)
+	GetUsersWithoutCurrency(ctx context.Context, currency string, limit int) ([]uint64, error)
+	CreditAllHolders(ctx context.Context, currency string, amount float64) (int, error)
+	ConnectionInfo() ConnInfo
+	GetUserTotalExposure(ctx context.Context, userID uint64) (float64, error)
+	GetCurrenciesLenient(ctx context.Context) (map[string]float64, error)
+	RegisterUser(ctx context.Context, email, password string) (uint64, error)
+	GetUserCurrencyCount(ctx context.Context, userID uint64) (int, error)
+	GetUserPortfolio(ctx context.Context, userID uint64) ([]PortfolioEntry, error)
+	SearchUsersByEmail(ctx context.Context, fragment string, limit int) ([]User, error)
+	SendCurrencyByEmail(ctx context.Context, sellerID uint64, buyerEmail, currency string, value float64) error
+	GetUserCurrencyAmount(ctx context.Context, userID uint64, currency string, defaultAmount float64) (float64, error)
+	GetUnheldCurrencies(ctx context.Context) ([]string, error)
+	NormalizeCurrencyCodes(ctx context.Context) error
+	CheckSchemaVersion(ctx context.Context, expected int) error
+	SendCurrencies(ctx context.Context, sellerID, buyerID uint64, amounts map[string]float64) error
+	GetUserRank(ctx context.Context, userID uint64) (int, int, error)
+	AdminSetBalance(ctx context.Context, adminID, userID uint64, currency string, newAmount float64, reason string) error
+	GetCurrencyHolders(ctx context.Context, currency string) ([]uint64, error)
+	GetCurrencyHoldersPage(ctx context.Context, currency string, limit, offset int) ([]uint64, error)
+	GetMarketCaps(ctx context.Context) ([]MarketCap, error)
+	MergeUsers(ctx context.Context, sourceID, targetID uint64) error
+	GetTradeCountsByCurrency(ctx context.Context, since time.Time) (map[string]int, error)
+	GetCurrenciesWithSupply(ctx context.Context) ([]CurrencyInfo, error)
+	FindOrphanBalances(ctx context.Context) ([]OrphanBalance, error)
+	GetLargestHolding(ctx context.Context, userID uint64) (string, float64, error)
+	CreateCurrency(ctx context.Context, currency string, value *float64) error
+	GetUsersByIDs(ctx context.Context, ids []uint64) (map[uint64]string, error)
+	SnapshotBalances(ctx context.Context) error
+	GetUserBalanceHistory(ctx context.Context, userID uint64, currency string, from, to time.Time) ([]BalanceSnapshot, error)
+	ReverseBatch(ctx context.Context, batchID uint64) error
+	GetCurrenciesByPopularity(ctx context.Context, limit int, includeUnheld bool) ([]CurrencyPopularity, error)
+	GetTradesBetween(ctx context.Context, userA, userB uint64, limit int) ([]Trade, error)
+	StreamCurrencyHolders(ctx context.Context, currency string, fn func(userID uint64) error) error
+	StreamBalances(ctx context.Context, fn func(balance Balance) error) error
+	SetCurrencyHalted(ctx context.Context, currency string, halted bool) error
+	GetUserNetFlow(ctx context.Context, userID uint64, currency string, from, to time.Time) (float64, float64, error)
+	PruneLedger(ctx context.Context, olderThan time.Time) (int64, error)
+	PruneCurrencyHistory(ctx context.Context, olderThan time.Time) (int64, error)
+	GetCirculatingSupply(ctx context.Context, currency string) (float64, float64, float64, error)
+	LaunchCurrency(ctx context.Context, currency string, value float64, allocations map[uint64]float64) error
+	GetCostBasis(ctx context.Context, userID uint64, currency string) (float64, error)
+	HaveTraded(ctx context.Context, userA, userB uint64) (bool, error)
+	SendAllCurrency(ctx context.Context, sellerID, buyerID uint64, currency string) (float64, error)
+	GetLastTradeTime(ctx context.Context, userID uint64) (time.Time, error)
+	GetReservedTotal(ctx context.Context, currency string) (float64, error)
+	GetUserTrades(ctx context.Context, userID uint64, filter TradeFilter) ([]Trade, error)
+	GetAuthRecord(ctx context.Context, email string) (uint64, string, error)
+	RehashPassword(ctx context.Context, userID uint64, oldHash, newHash string) error
+	GetCurrencyVolume(ctx context.Context, currency string) (float64, error)
+	FindLargeHolders(ctx context.Context, currency string, threshold float64) ([]HolderAmount, error)
+	GetCurrencyValueAt(ctx context.Context, currency string, at time.Time) (float64, error)
+	GetCurrencyDetail(ctx context.Context, currency string) (*CurrencyDetail, error)
+	SendCurrencyIfRate(ctx context.Context, sellerID, buyerID uint64, currency string, value, maxRate float64) error
+	Barter(ctx context.Context, userA, userB uint64, currencyA string, amountA float64, currencyB string, amountB float64) error
+	GetTotalCirculation(ctx context.Context) (float64, error)
+	FindOrphanUserBalances(ctx context.Context) ([]uint64, error)
+	GetUserTradeCount(ctx context.Context, userID uint64) (int, error)
+	GetCurrencyHistory(ctx context.Context, currency string, from, to time.Time, bucket time.Duration) ([]CurrencyHistoryPoint, error)
+	EmailExists(ctx context.Context, email string) (bool, error)
+	GetBalancesForCurrency(ctx context.Context, currency string, limit, offset int) ([]HolderAmount, error)
+	ZeroUserBalances(ctx context.Context, userID uint64) (int, error)
+	GetRateSpread(ctx context.Context) (min, max float64, minCurrency, maxCurrency string, err error)
+	GetVolumeTimeSeries(ctx context.Context, currency string, from, to time.Time, bucket time.Duration) ([]VolumePoint, error)
+	CountCurrenciesAboveValue(ctx context.Context, minValue float64) (int, error)
+	GetUserActivity(ctx context.Context, userID uint64, limit int) ([]ActivityEntry, error)
+	WithReadOnlyTx(ctx context.Context, fn func(h PostgresHandler) error) error
+	Begin(ctx context.Context) (Tx, error)
+	GetAverageHolding(ctx context.Context, currency string) (float64, error)
+	GetInactiveUsers(ctx context.Context, since time.Time, limit int) ([]User, error)
+	UpdateCurrencyBy(ctx context.Context, adminID uint64, currency string, newValue float64, reason string) error
+	GetConcentration(ctx context.Context, currency string, topN int) (float64, error)
+	RecomputeBalance(ctx context.Context, userID uint64, currency string) (stored, computed float64, err error)
+	Close()
 }
 
 type postgresClient struct {
-	connection *pgx.Conn
+	settings   PostgreSettings
+	connection querier
+	currencies *currencyCache
+	connInfo   ConnInfo
+
+	closed int32 // set to 1 by Close
+	close  func()
 }
 
 func (ps *PostgreSettings) Connect() PostgresHandler {
-	connStr := fmt.Sprintf("postgresql://%s:%s@%s/%s", ps.User, ps.Password, ps.Host, ps.DbName)
+	handler, err := ConnectContext(context.Background(), *ps)
+	if err != nil {
+		panic(err)
+	}
+
+	return handler
+}
+
+// ConnectContext connects to the postgres database; ctx bounds how long the connection may take.
+func ConnectContext(ctx context.Context, settings PostgreSettings) (PostgresHandler, error) {
+	host, err := normalizeHost(settings.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.Host = host
+
+	connStr := fmt.Sprintf("postgresql://%s:%s@%s/%s", settings.User, settings.Password, settings.Host, settings.DbName)
+
+	config, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the postgres connection string; err: %v", err)
+	}
+
+	if settings.Schema != "" {
+		config.ConnConfig.RuntimeParams["search_path"] = settings.Schema
+	}
+
+	if settings.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = settings.MaxConnLifetime
+	}
+
+	if settings.MaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = settings.MaxConnIdleTime
+	}
+
+	if settings.Logger != nil {
+		config.ConnConfig.Logger = correlationLogger{logger: settings.Logger}
+		if settings.LogLevel != 0 {
+			config.ConnConfig.LogLevel = settings.LogLevel
+		}
+	}
+
+	return connectWithSettings(ctx, config, settings)
+}
+
+// ConnectWithConfig connects to the postgres database using an already built pool config (custom dialers, TLS, etc.).
+// PostgreSettings are not used, so all the optional features they configure (fees, cache, tenants, ...) are disabled.
+func ConnectWithConfig(ctx context.Context, cfg *pgxpool.Config) (PostgresHandler, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("%w; config must not be nil", ErrInvalidArgument)
+	}
+
+	return connectWithSettings(ctx, cfg, PostgreSettings{})
+}
 
-	conn, err := pgx.Connect(context.Background(), connStr)
+func connectWithSettings(ctx context.Context, config *pgxpool.Config, settings PostgreSettings) (PostgresHandler, error) {
+	pool, err := pgxpool.ConnectConfig(ctx, config)
 	if err != nil {
-		panic(fmt.Errorf("cannot connect to the postgres database; err: %v", err))
+		return nil, fmt.Errorf("cannot connect to the postgres database; err: %v", err)
 	}
 
-	err = conn.Ping(context.Background())
+	err = pool.Ping(ctx)
 	if err != nil {
-		panic(fmt.Errorf("cannot ping the postgres database; error: %v", err))
+		pool.Close()
+		return nil, fmt.Errorf("cannot ping the postgres database; error: %v", err)
+	}
+
+	connection := withAcquireTimeout(pool, settings.AcquireTimeout)
+	closeConnection := pool.Close
+	if settings.TenantResolver != nil {
+		router := newTenantRouter(settings.TenantResolver, config, pool, settings.AcquireTimeout)
+		connection = router
+		closeConnection = router.Close
+	}
+
+	return &postgresClient{
+		settings:   settings,
+		connection: connection,
+		close:      closeConnection,
+		currencies: newCurrencyCache(settings.CurrencyCacheTTL),
+		connInfo: ConnInfo{
+			Host:   config.ConnConfig.Host,
+			Port:   config.ConnConfig.Port,
+			DbName: config.ConnConfig.Database,
+			User:   config.ConnConfig.User,
+		},
+	}, nil
+}
+
+// ConnectionInfo returns the host, port, database and user the handler connected to (without the password)
+func (pc *postgresClient) ConnectionInfo() ConnInfo {
+	return pc.connInfo
+}
+
+// Close closes all the connections; every call of the handler after Close returns ErrHandlerClosed.
+func (pc *postgresClient) Close() {
+	if atomic.CompareAndSwapInt32(&pc.closed, 0, 1) {
+		pc.close()
+	}
+}
+
+// tenant returns the tenant of the request or an empty string if there is no TenantResolver
+func (pc *postgresClient) tenant(ctx context.Context) string {
+	if pc.settings.TenantResolver == nil {
+		return ""
+	}
+
+	return pc.settings.TenantResolver(ctx)
+}
+
+func (pc *postgresClient) checkClosed() error {
+	if atomic.LoadInt32(&pc.closed) == 1 {
+		return ErrHandlerClosed
 	}
 
-	return &postgresClient{conn}
+	return nil
 }
 
 func (pc *postgresClient) GetCurrencies() (map[string]float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	tenant := pc.tenant(context.Background())
+	if cached, ok := pc.currencies.get(tenant); ok {
+		return cached, nil
+	}
+
+	generation := pc.currencies.currentGeneration(tenant)
+
 	res := make(map[string]float64)
 
-	rows, err := pc.connection.Query(context.Background(), "SELECT * FROM currencies")
+	rows, err := pc.connection.Query(context.Background(), "SELECT currency, value FROM currencies")
 	if err != nil {
 		return nil, fmt.Errorf("cannot get currencies from the postgres database; err: %v", err)
 	}
 
+	defer rows.Close()
+
 	for rows.Next() {
 		var currency string
-		var value float64
+		var value *float64
 		err = rows.Scan(&currency, &value)
 
 		if err != nil {
 			return nil, fmt.Errorf("cannot scan value from the postgres database; err: %v", err)
 		}
 
-		res[currency] = value
+		if value == nil {
+			return nil, fmt.Errorf("%w; currency %v", ErrNullRate, currency)
+		}
+
+		res[currency] = *value
 	}
 
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get currencies from the postgres database; err: %v", rows.Err())
+	}
+
+	pc.currencies.set(tenant, res, generation)
+
 	return res, nil
 }
 
 func (pc *postgresClient) UpdateCurrency(currency string, value float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
 	_, err := pc.connection.Exec(context.Background(),
-		`UPDATE currencies
-		 SET value = $1
-		 WHERE currency = $2`,
+		`WITH updated AS (
+			UPDATE currencies
+			SET value = $1, version = version + 1
+			WHERE currency = $2
+			RETURNING currency, value
+		 )
+		 INSERT INTO currency_history (currency, value)
+		 SELECT currency, value
+		 FROM updated`,
 		value,
 		currency)
 
@@ -85,12 +372,18 @@ func (pc *postgresClient) UpdateCurrency(currency string, value float64) error {
 		return fmt.Errorf("postgres can not update currency %v to the new value %v; err: %v", currency, value, err)
 	}
 
+	pc.currencies.invalidate(pc.tenant(context.Background()))
+
 	return nil
 }
 
 func (pc *postgresClient) GetUsersNum() (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
 	res := 0
-	err := pc.connection.QueryRow(context.Background(), "SELECT COUNT(id) FROM users").Scan(&res)
+	err := pc.connection.QueryRow(context.Background(), "SELECT COUNT(id) FROM users WHERE deleted_at IS NULL").Scan(&res)
 
 	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return 0, fmt.Errorf("cann get number of users from the postgres database; error: %v", err)
@@ -100,10 +393,20 @@ func (pc *postgresClient) GetUsersNum() (int, error) {
 }
 
 func (pc *postgresClient) GetCurrencyAmount(currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
 	amount := float64(0)
 	err := pc.connection.QueryRow(
 		context.Background(),
-		`SELECT SUM(amount)
+		`SELECT COALESCE(SUM(amount), 0)
 		 FROM users_money
 		 WHERE currency = $1`,
 		currency,
@@ -121,6 +424,16 @@ func (pc *postgresClient) GetCurrencyAmount(currency string) (float64, error) {
 }
 
 func (pc *postgresClient) GetCurrencyValue(currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
 	row := pc.connection.QueryRow(
 		context.Background(),
 		`SELECT value 
@@ -132,6 +445,10 @@ func (pc *postgresClient) GetCurrencyValue(currency string) (float64, error) {
 	value := float64(0)
 	err := row.Scan(&value)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+		}
+
 		return 0, fmt.Errorf("cannot get currencies'(%v) value; err: %v", currency, err)
 	}
 
@@ -139,6 +456,12 @@ func (pc *postgresClient) GetCurrencyValue(currency string) (float64, error) {
 }
 
 func (pc *postgresClient) UpdateCurrencyAmount(userID uint64, currency string, value float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
 	_, err := pc.connection.Exec(
 		context.Background(),
 		`
@@ -160,6 +483,14 @@ func (pc *postgresClient) UpdateCurrencyAmount(userID uint64, currency string, v
 }
 
 func (pc *postgresClient) AddUser(email, password string) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := pc.allow(registerRateLimitKey(email)); err != nil {
+		return err
+	}
+
 	_, err := pc.connection.Exec(
 		context.Background(),
 		`INSERT INTO users (email, pass)
@@ -176,31 +507,21 @@ func (pc *postgresClient) AddUser(email, password string) error {
 }
 
 func (pc *postgresClient) GetUserData(email string) (uint64, string, error) {
-	id := uint64(0)
-	password := ""
-
-	row := pc.connection.QueryRow(
-		context.Background(),
-		`SELECT id, pass 
-		 FROM users 
-		 WHERE email = $1`,
-		email,
-	)
-
-	err := row.Scan(&id, &password)
-
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return 0, "", err
-		}
-
-		return 0, "", fmt.Errorf("postgres cannot return user's data (email = %v); err: %v", email, err)
+	id, password, err := pc.GetAuthRecord(context.Background(), email)
+	if errors.Is(err, ErrUserNotFound) {
+		return 0, "", pgx.ErrNoRows
 	}
 
-	return id, password, nil
+	return id, password, err
 }
 
 func (pc *postgresClient) GetUserMoney(userID uint64, currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
 	rows := pc.connection.QueryRow(
 		context.Background(),
 		`SELECT amount 
@@ -225,14 +546,28 @@ func (pc *postgresClient) GetUserMoney(userID uint64, currency string) (float64,
 	return amount, nil
 }
 
+// FindSeller returns the user with the lowest id that has at least value of the currency,
+// so repeated calls over the same data return the same seller.
 func (pc *postgresClient) FindSeller(currency string, value float64) (uint64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
 	sellerID := uint64(0)
 	rows := pc.connection.QueryRow(
 		context.Background(),
 		`SELECT user_id 
 		 FROM users_money 
 		 WHERE currency = $1
-		 AND amount >= $2`,
+		 AND amount >= $2
+		 ORDER BY user_id
+		 LIMIT 1`,
 		currency,
 		value,
 	)
@@ -250,59 +585,192 @@ func (pc *postgresClient) FindSeller(currency string, value float64) (uint64, er
 }
 
 func (pc *postgresClient) SendCurrency(sellerID, buyerID uint64, currency string, value float64) error {
-	tx, err := pc.connection.Begin(context.Background())
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
 
-	if err != nil {
-		return fmt.Errorf("cannot start transaction; err %v", err)
+	if err := requireDifferentUsers(sellerID, buyerID); err != nil {
+		return err
 	}
 
-	amount := float64(0)
+	if err := pc.allow(sendRateLimitKey(sellerID)); err != nil {
+		return err
+	}
 
-	rows, err := tx.Query(
-		context.Background(),
-		`SELECT amount 
-		 FROM users_money 
-		 WHERE currency = $1
-		 AND user_id = $2`,
-		currency,
-		sellerID,
-	)
+	ctx := context.Background()
 
-	if err != nil {
-		tx.Rollback(context.Background())
+	return retryOnTxConflict(ctx, func() error {
+		tx, err := pc.connection.BeginTx(ctx, pc.settings.SendCurrencyTxOptions)
 
-		if errors.Is(err, pgx.ErrNoRows) {
-			return fmt.Errorf("%w; user with id %v does not have %v %v", pgx.ErrNoRows, sellerID, value, currency)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction; err %w", err)
+		}
+
+		_, err = transfer(ctx, tx, LedgerOperationTrade, sellerID, buyerID, currency, value)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot rollback transaction; err: %w", err)
 		}
 
-		return fmt.Errorf("cannot get %v %v from the users_money table; err: %v", value, currency, err)
+		return nil
+	})
+}
+
+// SendCurrencyWithFee works as SendCurrency but takes the FeePercent of the value and credits it to the FeeAccountID.
+// The seller pays value, the buyer receives value - fee.
+func (pc *postgresClient) SendCurrencyWithFee(ctx context.Context, sellerID, buyerID uint64, currency string, value float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
 	}
 
-	for rows.Next() {
-		err = rows.Scan(&amount)
+	if err := requireDifferentUsers(sellerID, buyerID); err != nil {
+		return err
+	}
+
+	if err := pc.allow(sendRateLimitKey(sellerID)); err != nil {
+		return err
+	}
+
+	if pc.settings.FeePercent < 0 || pc.settings.FeePercent > 100 {
+		return fmt.Errorf("fee percent must be within [0, 100]; got %v", pc.settings.FeePercent)
+	}
+
+	fee := value * pc.settings.FeePercent / 100
+	if fee > 0 && pc.settings.FeeAccountID == 0 {
+		return errors.New("fee account is not configured")
+	}
+
+	return retryOnTxConflict(ctx, func() error {
+		tx, err := pc.connection.BeginTx(ctx, pc.settings.SendCurrencyTxOptions)
 		if err != nil {
+			return fmt.Errorf("cannot start transaction; err %w", err)
+		}
+
+		_, err = transfer(ctx, tx, LedgerOperationTrade, sellerID, buyerID, currency, value-fee)
+		if err != nil {
+			tx.Rollback(ctx)
 			return err
 		}
+
+		if fee > 0 {
+			_, err = transfer(ctx, tx, LedgerOperationFee, sellerID, pc.settings.FeeAccountID, currency, fee)
+			if err != nil {
+				tx.Rollback(ctx)
+				return fmt.Errorf("cannot charge fee; err: %w", err)
+			}
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot commit transaction; err: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// transfer moves value of the currency from the seller to the buyer within tx and writes it to the ledger.
+// The seller's balance is locked for the rest of tx; fails with ErrInsufficientFunds if it is less than value.
+// The buyer is locked against MergeUsers as well; fails with ErrUserNotFound if the buyer does not exist or was merged.
+// Fails with ErrBelowMinimumBalance if the seller would keep less than the min_balance of the currency
+// and with ErrTradingHalted if trading of the currency is halted (refunds are still allowed).
+// Trades are also added to the total volume of the currency in currency_stats.
+// Returns the id of the ledger entry. The caller is responsible for rolling tx back on error.
+func transfer(ctx context.Context, tx pgx.Tx, operation string, sellerID, buyerID uint64, currency string, value float64) (uint64, error) {
+	currency = normalizeCurrency(currency)
+
+	if value < 0 {
+		return 0, fmt.Errorf("%w; cannot transfer a negative amount %v %v", ErrInvalidArgument, value, currency)
+	}
+
+	// MergeUsers locks both users for update, so the buyer cannot be merged away until tx ends
+	buyerExists := false
+	err := tx.QueryRow(
+		ctx,
+		`SELECT EXISTS(
+			SELECT 1
+			FROM users
+			WHERE id = $1
+			AND deleted_at IS NULL
+			FOR SHARE
+		 )`,
+		buyerID,
+	).Scan(&buyerExists)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot lock the buyer (id = %v); err: %w", buyerID, err)
+	}
+
+	if !buyerExists {
+		return 0, fmt.Errorf("%w; user id %v", ErrUserNotFound, buyerID)
+	}
+
+	// the row stays locked until tx ends, so concurrent transfers of the seller wait for each other
+	amount := float64(0)
+	err = tx.QueryRow(
+		ctx,
+		`SELECT amount
+		 FROM users_money
+		 WHERE currency = $1
+		 AND user_id = $2
+		 FOR UPDATE`,
+		currency,
+		sellerID,
+	).Scan(&amount)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("cannot get %v %v from the users_money table; err: %w", value, currency, err)
+	}
+
+	if amount < value {
+		return 0, fmt.Errorf("%w; user with id %v does not have %v %v", ErrInsufficientFunds, sellerID, value, currency)
+	}
+
+	minBalance := float64(0)
+	halted := false
+	var price *float64
+	err = tx.QueryRow(
+		ctx,
+		`SELECT min_balance, trading_halted, value
+		 FROM currencies
+		 WHERE currency = $1`,
+		currency,
+	).Scan(&minBalance, &halted, &price)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("cannot get trading rules of the currency %v; err: %w", currency, err)
+	}
+
+	if halted && operation != LedgerOperationRefund {
+		return 0, fmt.Errorf("%w; currency %v", ErrTradingHalted, currency)
+	}
+
+	if minBalance > 0 && amount-value < minBalance {
+		return 0, fmt.Errorf("%w; user with id %v must keep at least %v %v", ErrBelowMinimumBalance, sellerID, minBalance, currency)
 	}
 
 	_, err = tx.Exec(
-		context.Background(),
+		ctx,
 		`UPDATE users_money
-		 SET amount = $1
+		 SET amount = amount - $1
 		 WHERE user_id = $2
 		 AND currency = $3`,
-		amount-value,
+		value,
 		sellerID,
 		currency,
 	)
 
 	if err != nil {
-		tx.Rollback(context.Background())
-		return fmt.Errorf("cannot sell user's (id = %v) currency(%s); err: %v", sellerID, currency, err)
+		return 0, fmt.Errorf("cannot sell user's (id = %v) currency(%s); err: %w", sellerID, currency, err)
 	}
 
 	_, err = tx.Exec(
-		context.Background(),
+		ctx,
 		`
 		 INSERT into users_money (user_id, currency, amount)
 		 VALUES ($1, $2, $3)
@@ -315,14 +783,3979 @@ func (pc *postgresClient) SendCurrency(sellerID, buyerID uint64, currency string
 	)
 
 	if err != nil {
-		tx.Rollback(context.Background())
-		return fmt.Errorf("cannot update currency amount; err: %v", err)
+		return 0, fmt.Errorf("cannot update currency amount; err: %w", err)
+	}
+
+	ledgerID := uint64(0)
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO ledger (operation, seller_id, buyer_id, currency, amount, price)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id`,
+		operation,
+		sellerID,
+		buyerID,
+		currency,
+		value,
+		price,
+	).Scan(&ledgerID)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot write %v to the ledger; err: %w", operation, err)
+	}
+
+	if operation == LedgerOperationTrade {
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO currency_stats (currency, total_volume)
+			 VALUES ($1, $2)
+			 ON CONFLICT (currency)
+			 DO UPDATE
+			 SET total_volume = currency_stats.total_volume + EXCLUDED.total_volume`,
+			currency,
+			value,
+		)
+
+		if err != nil {
+			return 0, fmt.Errorf("cannot update volume of the currency %v; err: %w", currency, err)
+		}
+	}
+
+	return ledgerID, nil
+}
+
+// RecallCurrency sets every user's amount of the currency to 0 and writes a ledger entry per affected user.
+// Returns the number of affected users.
+func (pc *postgresClient) RecallCurrency(ctx context.Context, currency string) (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
 	}
 
-	err = tx.Commit(context.Background())
+	currency = normalizeCurrency(currency)
+
+	tx, err := pc.connection.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot rollback transaction; err: %v", err)
+		return 0, fmt.Errorf("cannot start transaction; err %v", err)
 	}
 
-	return nil
+	rows, err := tx.Query(
+		ctx,
+		`UPDATE users_money um
+		 SET amount = 0
+		 FROM users_money old
+		 WHERE old.id = um.id
+		 AND um.currency = $1
+		 AND um.amount <> 0
+		 RETURNING um.user_id, old.amount`,
+		currency,
+	)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, fmt.Errorf("cannot recall currency %v; err: %v", currency, err)
+	}
+
+	recalled := make(map[uint64]float64)
+	for rows.Next() {
+		var userID uint64
+		var amount float64
+		err = rows.Scan(&userID, &amount)
+
+		if err != nil {
+			rows.Close()
+			tx.Rollback(ctx)
+			return 0, fmt.Errorf("cannot scan recalled amount of the currency %v; err: %v", currency, err)
+		}
+
+		recalled[userID] = amount
+	}
+
+	if rows.Err() != nil {
+		tx.Rollback(ctx)
+		return 0, fmt.Errorf("cannot recall currency %v; err: %v", currency, rows.Err())
+	}
+
+	for userID, amount := range recalled {
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO ledger (operation, seller_id, currency, amount)
+			 VALUES ($1, $2, $3, $4)`,
+			LedgerOperationRecall,
+			userID,
+			currency,
+			amount,
+		)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return 0, fmt.Errorf("cannot write ledger entry for user's (id = %v) recalled currency (%v); err: %v", userID, currency, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return len(recalled), nil
+}
+
+// ListUsersAfter returns up to limit users with id greater than afterID ordered by id.
+// To request the next page pass the ID of the last returned user as afterID;
+// a page shorter than limit means there are no more users.
+func (pc *postgresClient) ListUsersAfter(ctx context.Context, afterID uint64, limit int) ([]User, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT id, email
+		 FROM users
+		 WHERE id > $1
+		 AND deleted_at IS NULL
+		 ORDER BY id
+		 LIMIT $2`,
+		afterID,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get users after id %v from the postgres database; err: %v", afterID, err)
+	}
+
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user := User{}
+		err = rows.Scan(&user.ID, &user.Email)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user from the postgres database; err: %v", err)
+		}
+
+		users = append(users, user)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get users after id %v from the postgres database; err: %v", afterID, rows.Err())
+	}
+
+	return users, nil
+}
+
+func (pc *postgresClient) GetCurrencyWithVersion(ctx context.Context, currency string) (float64, int64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	value := float64(0)
+	version := int64(0)
+
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT value, version
+		 FROM currencies
+		 WHERE currency = $1`,
+		currency,
+	).Scan(&value, &version)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, 0, fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+		}
+
+		return 0, 0, fmt.Errorf("cannot get currencies'(%v) value and version; err: %v", currency, err)
+	}
+
+	return value, version, nil
+}
+
+// UpdateCurrencyCAS updates the currency value only if its version still equals expectedVersion.
+// Returns ErrVersionConflict if the currency was updated by someone else in the meantime.
+func (pc *postgresClient) UpdateCurrencyCAS(ctx context.Context, currency string, newValue float64, expectedVersion int64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	tag, err := pc.connection.Exec(
+		ctx,
+		`WITH updated AS (
+			UPDATE currencies
+			SET value = $1, version = version + 1
+			WHERE currency = $2
+			AND version = $3
+			RETURNING currency, value
+		 )
+		 INSERT INTO currency_history (currency, value)
+		 SELECT currency, value
+		 FROM updated`,
+		newValue,
+		currency,
+		expectedVersion,
+	)
+
+	if err != nil {
+		return fmt.Errorf("postgres can not update currency %v to the new value %v; err: %v", currency, newValue, err)
+	}
+
+	pc.currencies.invalidate(pc.tenant(ctx))
+
+	if tag.RowsAffected() == 0 {
+		exists := false
+		err = pc.connection.QueryRow(
+			ctx,
+			"SELECT EXISTS(SELECT 1 FROM currencies WHERE currency = $1)",
+			currency,
+		).Scan(&exists)
+
+		if err != nil {
+			return fmt.Errorf("cannot check whether currency %v exists; err: %v", currency, err)
+		}
+
+		if !exists {
+			return fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+		}
+
+		return fmt.Errorf("%w; currency %v is not of the version %v anymore", ErrVersionConflict, currency, expectedVersion)
+	}
+
+	return nil
+}
+
+// GetTradeVolume returns the user's trade volume per currency within [from, to).
+// Sent and received amounts are added up, not netted against each other,
+// so the result is the gross turnover of the user in every currency.
+func (pc *postgresClient) GetTradeVolume(ctx context.Context, userID uint64, from, to time.Time) (map[string]float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT currency, SUM(amount)
+		 FROM ledger
+		 WHERE operation = $1
+		 AND (seller_id = $2 OR buyer_id = $2)
+		 AND created_at >= $3
+		 AND created_at < $4
+		 GROUP BY currency`,
+		LedgerOperationTrade,
+		userID,
+		from,
+		to,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get user's (id = %v) trade volume; err: %v", userID, err)
+	}
+
+	defer rows.Close()
+
+	res := make(map[string]float64)
+	for rows.Next() {
+		var currency string
+		var volume float64
+		err = rows.Scan(&currency, &volume)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user's (id = %v) trade volume; err: %v", userID, err)
+		}
+
+		res[currency] = volume
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get user's (id = %v) trade volume; err: %v", userID, rows.Err())
+	}
+
+	return res, nil
+}
+
+// GetAffordableCurrencies returns currencies the user can buy at least one unit of
+// with their holdings of the baseCurrency, sorted by value ascending.
+func (pc *postgresClient) GetAffordableCurrencies(ctx context.Context, userID uint64, baseCurrency string) ([]string, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	baseCurrency = normalizeCurrency(baseCurrency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT c.currency
+		 FROM users_money um
+		 JOIN currencies base ON base.currency = um.currency
+		 JOIN currencies c ON c.currency <> um.currency
+		 WHERE um.user_id = $1
+		 AND um.currency = $2
+		 AND c.value > 0
+		 AND c.value <= um.amount * base.value
+		 ORDER BY c.value`,
+		userID,
+		baseCurrency,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get currencies affordable for the user (id = %v); err: %v", userID, err)
+	}
+
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		var currency string
+		err = rows.Scan(&currency)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan currency affordable for the user (id = %v); err: %v", userID, err)
+		}
+
+		res = append(res, currency)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get currencies affordable for the user (id = %v); err: %v", userID, rows.Err())
+	}
+
+	return res, nil
+}
+
+// RecordLogin writes a sign-in attempt of the user to login_events. The handler does not verify passwords,
+// so it never records logins by itself; the caller has to call it after every check of the password hash.
+func (pc *postgresClient) RecordLogin(ctx context.Context, userID uint64, ip string, success bool) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	_, err := pc.connection.Exec(
+		ctx,
+		`INSERT INTO login_events (user_id, ip, success)
+		 VALUES ($1, $2, $3)`,
+		userID,
+		ip,
+		success,
+	)
+
+	if err != nil {
+		return fmt.Errorf("cannot record login of the user (id = %v); err: %v", userID, err)
+	}
+
+	return nil
+}
+
+// GetRecentLogins returns up to limit latest login events of the user, newest first.
+func (pc *postgresClient) GetRecentLogins(ctx context.Context, userID uint64, limit int) ([]LoginEvent, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT COALESCE(ip, ''), success, created_at
+		 FROM login_events
+		 WHERE user_id = $1
+		 ORDER BY created_at DESC
+		 LIMIT $2`,
+		userID,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get login events of the user (id = %v); err: %v", userID, err)
+	}
+
+	defer rows.Close()
+
+	events := []LoginEvent{}
+	for rows.Next() {
+		event := LoginEvent{}
+		err = rows.Scan(&event.IP, &event.Success, &event.CreatedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan login event of the user (id = %v); err: %v", userID, err)
+		}
+
+		events = append(events, event)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get login events of the user (id = %v); err: %v", userID, rows.Err())
+	}
+
+	return events, nil
+}
+
+// FindDuplicateEmails returns emails that are used by more than one user (case-insensitive)
+// together with the ids of these users.
+func (pc *postgresClient) FindDuplicateEmails(ctx context.Context) (map[string][]uint64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT LOWER(email), ARRAY_AGG(id ORDER BY id)
+		 FROM users
+		 WHERE deleted_at IS NULL
+		 GROUP BY LOWER(email)
+		 HAVING COUNT(*) > 1`,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get duplicate emails from the postgres database; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	res := make(map[string][]uint64)
+	for rows.Next() {
+		var email string
+		var ids []int64
+		err = rows.Scan(&email, &ids)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan duplicate email from the postgres database; err: %v", err)
+		}
+
+		for _, id := range ids {
+			res[email] = append(res[email], uint64(id))
+		}
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get duplicate emails from the postgres database; err: %v", rows.Err())
+	}
+
+	return res, nil
+}
+
+func (pc *postgresClient) GetCurrenciesNum(ctx context.Context) (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	res := 0
+	err := pc.connection.QueryRow(ctx, "SELECT COUNT(*) FROM currencies").Scan(&res)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get number of currencies from the postgres database; err: %v", err)
+	}
+
+	return res, nil
+}
+
+// RefundTrade moves the traded currency back from the buyer to the seller
+// and writes a refund ledger entry that references the trade.
+func (pc *postgresClient) RefundTrade(ctx context.Context, tradeID uint64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	var sellerID, buyerID uint64
+	var currency string
+	var value float64
+
+	err = tx.QueryRow(
+		ctx,
+		`SELECT seller_id, buyer_id, currency, amount
+		 FROM ledger
+		 WHERE id = $1
+		 AND operation = $2
+		 FOR UPDATE`,
+		tradeID,
+		LedgerOperationTrade,
+	).Scan(&sellerID, &buyerID, &currency, &value)
+
+	if err != nil {
+		tx.Rollback(ctx)
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w; trade id %v", ErrTradeNotFound, tradeID)
+		}
+
+		return fmt.Errorf("cannot get trade (id = %v); err: %v", tradeID, err)
+	}
+
+	refunded := false
+	err = tx.QueryRow(
+		ctx,
+		"SELECT EXISTS(SELECT 1 FROM ledger WHERE reference_id = $1 AND operation = $2)",
+		tradeID,
+		LedgerOperationRefund,
+	).Scan(&refunded)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot check whether trade (id = %v) was refunded; err: %v", tradeID, err)
+	}
+
+	if refunded {
+		tx.Rollback(ctx)
+		return fmt.Errorf("%w; trade id %v", ErrTradeAlreadyRefunded, tradeID)
+	}
+
+	amount := float64(0)
+	err = tx.QueryRow(
+		ctx,
+		`SELECT amount
+		 FROM users_money
+		 WHERE user_id = $1
+		 AND currency = $2
+		 FOR UPDATE`,
+		buyerID,
+		currency,
+	).Scan(&amount)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot get user's (id = %v) amount of the currency (%v); err: %v", buyerID, currency, err)
+	}
+
+	if amount < value {
+		tx.Rollback(ctx)
+		return fmt.Errorf("%w; user with id %v does not have %v %v anymore", ErrInsufficientFunds, buyerID, value, currency)
+	}
+
+	refundID, err := transfer(ctx, tx, LedgerOperationRefund, buyerID, sellerID, currency, value)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE ledger
+		 SET reference_id = $1
+		 WHERE id = $2`,
+		tradeID,
+		refundID,
+	)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot link refund to the trade (id = %v); err: %v", tradeID, err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return nil
+}
+
+// GetExchangeRate returns how many units of the currency "to" one unit of the currency "from" costs.
+func (pc *postgresClient) GetExchangeRate(ctx context.Context, from, to string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	from = normalizeCurrency(from)
+	to = normalizeCurrency(to)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT currency, value
+		 FROM currencies
+		 WHERE currency = $1
+		 OR currency = $2`,
+		from,
+		to,
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get values of the currencies %v and %v; err: %v", from, to, err)
+	}
+
+	defer rows.Close()
+
+	values := make(map[string]float64, 2)
+	for rows.Next() {
+		var currency string
+		var value float64
+		err = rows.Scan(&currency, &value)
+
+		if err != nil {
+			return 0, fmt.Errorf("cannot scan value from the postgres database; err: %v", err)
+		}
+
+		values[currency] = value
+	}
+
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("cannot get values of the currencies %v and %v; err: %v", from, to, rows.Err())
+	}
+
+	for _, currency := range []string{from, to} {
+		if _, ok := values[currency]; !ok {
+			return 0, fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+		}
+	}
+
+	if values[to] == 0 {
+		return 0, fmt.Errorf("%w; currency %v", ErrZeroRate, to)
+	}
+
+	return values[from] / values[to], nil
+}
+
+// GetRecentTrades returns up to limit latest trades of the whole exchange, newest first.
+// SellerID and BuyerID are left 0 if AnonymousRecentTrades is set.
+func (pc *postgresClient) GetRecentTrades(ctx context.Context, limit int) ([]Trade, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT id, seller_id, buyer_id, currency, amount, created_at
+		 FROM ledger
+		 WHERE operation = $1
+		 ORDER BY created_at DESC
+		 LIMIT $2`,
+		LedgerOperationTrade,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get recent trades from the postgres database; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	trades := []Trade{}
+	for rows.Next() {
+		trade := Trade{}
+		err = rows.Scan(&trade.ID, &trade.SellerID, &trade.BuyerID, &trade.Currency, &trade.Amount, &trade.CreatedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan trade from the postgres database; err: %v", err)
+		}
+
+		if pc.settings.AnonymousRecentTrades {
+			trade.SellerID = 0
+			trade.BuyerID = 0
+		}
+
+		trades = append(trades, trade)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get recent trades from the postgres database; err: %v", rows.Err())
+	}
+
+	return trades, nil
+}
+
+// GetUsersWithoutCurrency returns up to limit ids (ordered by id) of the users that hold none of the currency.
+// Users who got the currency stop matching, so an airdrop can page through everybody by calling it
+// again after crediting the previous page. The query is an anti-join on the unique (user_id, currency)
+// index of users_money, yet with a large user base every page still scans users from the start;
+// keep the limit in the thousands rather than fetching everyone at once.
+func (pc *postgresClient) GetUsersWithoutCurrency(ctx context.Context, currency string, limit int) ([]uint64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT u.id
+		 FROM users u
+		 WHERE u.deleted_at IS NULL
+		 AND NOT EXISTS (
+			SELECT 1
+			FROM users_money um
+			WHERE um.user_id = u.id
+			AND um.currency = $1
+			AND um.amount > 0
+		 )
+		 ORDER BY u.id
+		 LIMIT $2`,
+		currency,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get users without the currency %v; err: %v", currency, err)
+	}
+
+	defer rows.Close()
+
+	ids := []uint64{}
+	for rows.Next() {
+		var id uint64
+		err = rows.Scan(&id)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user id from the postgres database; err: %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get users without the currency %v; err: %v", currency, rows.Err())
+	}
+
+	return ids, nil
+}
+
+// CreditAllHolders adds the amount to the balance of every user holding the currency (with a positive balance)
+// and writes a ledger entry per credited user. Returns the number of credited users.
+// Fails with ErrInvalidArgument if the amount is not positive.
+func (pc *postgresClient) CreditAllHolders(ctx context.Context, currency string, amount float64) (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	if amount <= 0 {
+		return 0, fmt.Errorf("%w; cannot credit a non-positive amount %v %v", ErrInvalidArgument, amount, currency)
+	}
+
+	currency = normalizeCurrency(currency)
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`UPDATE users_money
+		 SET amount = amount + $1
+		 WHERE currency = $2
+		 AND amount > 0
+		 RETURNING user_id`,
+		amount,
+		currency,
+	)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, fmt.Errorf("cannot credit holders of the currency %v; err: %v", currency, err)
+	}
+
+	credited := []uint64{}
+	for rows.Next() {
+		var userID uint64
+		err = rows.Scan(&userID)
+
+		if err != nil {
+			rows.Close()
+			tx.Rollback(ctx)
+			return 0, fmt.Errorf("cannot scan credited holder of the currency %v; err: %v", currency, err)
+		}
+
+		credited = append(credited, userID)
+	}
+
+	if rows.Err() != nil {
+		tx.Rollback(ctx)
+		return 0, fmt.Errorf("cannot credit holders of the currency %v; err: %v", currency, rows.Err())
+	}
+
+	for _, userID := range credited {
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO ledger (operation, buyer_id, currency, amount)
+			 VALUES ($1, $2, $3, $4)`,
+			LedgerOperationCredit,
+			userID,
+			currency,
+			amount,
+		)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return 0, fmt.Errorf("cannot write ledger entry for user's (id = %v) credited currency (%v); err: %v", userID, currency, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return len(credited), nil
+}
+
+// GetUserTotalExposure returns the value of all the user's holdings, i.e. sum of amount * value of every currency
+func (pc *postgresClient) GetUserTotalExposure(ctx context.Context, userID uint64) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	exposure := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COALESCE(SUM(um.amount * c.value), 0)
+		 FROM users u
+		 LEFT JOIN users_money um ON um.user_id = u.id
+		 LEFT JOIN currencies c ON c.currency = um.currency
+		 WHERE u.id = $1
+		 GROUP BY u.id`,
+		userID,
+	).Scan(&exposure)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("%w; user id %v", ErrUserNotFound, userID)
+		}
+
+		return 0, fmt.Errorf("cannot get user's (id = %v) total exposure; err: %v", userID, err)
+	}
+
+	return exposure, nil
+}
+
+// GetCurrenciesLenient works as GetCurrencies but skips rows that cannot be scanned instead of failing.
+// Returns the scanned currencies together with an ErrPartialResult naming the skipped ones.
+func (pc *postgresClient) GetCurrenciesLenient(ctx context.Context) (map[string]float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(ctx, "SELECT currency, value FROM currencies")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get currencies from the postgres database; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	res := make(map[string]float64)
+	skipped := []string{}
+	for rows.Next() {
+		// a failed Scan closes the rows, so value is scanned into a pointer and checked here instead
+		var currency string
+		var value *float64
+		err = rows.Scan(&currency, &value)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan value from the postgres database; err: %v", err)
+		}
+
+		if value == nil {
+			skipped = append(skipped, fmt.Sprintf("%v (%v)", currency, ErrNullRate))
+			continue
+		}
+
+		res[currency] = *value
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get currencies from the postgres database; err: %v", rows.Err())
+	}
+
+	if len(skipped) > 0 {
+		return res, fmt.Errorf("%w; skipped currencies: %v", ErrPartialResult, strings.Join(skipped, ", "))
+	}
+
+	return res, nil
+}
+
+// RegisterUser adds the user, credits the SignupBonus to the user and returns the user's id;
+// returns ErrUserExists if the email is already taken. The user and the bonus are inserted in one transaction.
+// It relies on the unique index of the emails of the users that are not deleted, so concurrent registrations
+// cannot both succeed while the email of a merged user can be registered again.
+func (pc *postgresClient) RegisterUser(ctx context.Context, email, password string) (uint64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := pc.allow(registerRateLimitKey(email)); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("email", email); err != nil {
+		return 0, err
+	}
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	id := uint64(0)
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO users (email, pass)
+		 VALUES ($1, $2)
+		 ON CONFLICT (email) WHERE deleted_at IS NULL DO NOTHING
+		 RETURNING id`,
+		email,
+		password,
+	).Scan(&id)
+
+	if err != nil {
+		tx.Rollback(ctx)
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("%w; email %v", ErrUserExists, email)
+		}
+
+		return 0, fmt.Errorf("cannot register user (email: %v); err: %v", email, err)
+	}
+
+	for currency, amount := range pc.settings.SignupBonus {
+		currency = normalizeCurrency(currency)
+
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO users_money (user_id, currency, amount)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (user_id, currency)
+			 DO UPDATE
+			 SET amount = users_money.amount + EXCLUDED.amount`,
+			id,
+			currency,
+			amount,
+		)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return 0, fmt.Errorf("cannot credit signup bonus %v %v to the user (email: %v); err: %v", amount, currency, email, err)
+		}
+
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO ledger (operation, buyer_id, currency, amount)
+			 VALUES ($1, $2, $3, $4)`,
+			LedgerOperationBonus,
+			id,
+			currency,
+			amount,
+		)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return 0, fmt.Errorf("cannot write signup bonus of the user (email: %v) to the ledger; err: %v", email, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return id, nil
+}
+
+// GetUserCurrencyCount returns how many currencies the user holds; 0 for unknown users
+func (pc *postgresClient) GetUserCurrencyCount(ctx context.Context, userID uint64) (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	res := 0
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COUNT(*)
+		 FROM users_money
+		 WHERE user_id = $1
+		 AND amount > 0`,
+		userID,
+	).Scan(&res)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get number of currencies of the user (id = %v); err: %v", userID, err)
+	}
+
+	return res, nil
+}
+
+// GetUserPortfolio returns every holding of the user with the current rate of its currency, sorted by value descending.
+// Amounts and rates are read by a single query, so they are consistent with each other.
+func (pc *postgresClient) GetUserPortfolio(ctx context.Context, userID uint64) ([]PortfolioEntry, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT um.currency, um.amount, c.value, um.amount * c.value AS total
+		 FROM users_money um
+		 JOIN currencies c ON c.currency = um.currency
+		 WHERE um.user_id = $1
+		 ORDER BY total DESC`,
+		userID,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get user's (id = %v) portfolio; err: %v", userID, err)
+	}
+
+	defer rows.Close()
+
+	portfolio := []PortfolioEntry{}
+	for rows.Next() {
+		entry := PortfolioEntry{}
+		err = rows.Scan(&entry.Currency, &entry.Amount, &entry.Rate, &entry.Value)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user's (id = %v) portfolio entry; err: %v", userID, err)
+		}
+
+		portfolio = append(portfolio, entry)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get user's (id = %v) portfolio; err: %v", userID, rows.Err())
+	}
+
+	return portfolio, nil
+}
+
+// SearchUsersByEmail returns up to limit users whose email contains the fragment (case-insensitive), ordered by id.
+// Wildcards in the fragment are matched literally.
+func (pc *postgresClient) SearchUsersByEmail(ctx context.Context, fragment string, limit int) ([]User, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("fragment", fragment); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT id, email
+		 FROM users
+		 WHERE email ILIKE '%' || $1 || '%' ESCAPE '\'
+		 AND deleted_at IS NULL
+		 ORDER BY id
+		 LIMIT $2`,
+		escapeLike(fragment),
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot search users by email %v; err: %v", fragment, err)
+	}
+
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user := User{}
+		err = rows.Scan(&user.ID, &user.Email)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user from the postgres database; err: %v", err)
+		}
+
+		users = append(users, user)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot search users by email %v; err: %v", fragment, rows.Err())
+	}
+
+	return users, nil
+}
+
+// escapeLike escapes the LIKE wildcards so the value is matched literally with ESCAPE '\'
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// SendCurrencyByEmail works as SendCurrency but identifies the buyer by email (ignoring the case).
+// Returns ErrUserNotFound if nobody uses buyerEmail.
+func (pc *postgresClient) SendCurrencyByEmail(ctx context.Context, sellerID uint64, buyerEmail, currency string, value float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("email", buyerEmail); err != nil {
+		return err
+	}
+
+	if err := pc.allow(sendRateLimitKey(sellerID)); err != nil {
+		return err
+	}
+
+	return retryOnTxConflict(ctx, func() error {
+		tx, err := pc.connection.BeginTx(ctx, pc.settings.SendCurrencyTxOptions)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction; err %w", err)
+		}
+
+		// emails are matched ignoring the case as in EmailExists; an exact match wins if several users differ in case only
+		buyerID := uint64(0)
+		err = tx.QueryRow(
+			ctx,
+			`SELECT id
+			 FROM users
+			 WHERE LOWER(email) = LOWER($1)
+			 AND deleted_at IS NULL
+			 ORDER BY email = $1 DESC, id
+			 LIMIT 1`,
+			strings.TrimSpace(buyerEmail),
+		).Scan(&buyerID)
+
+		if err != nil {
+			tx.Rollback(ctx)
+
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("%w; email %v", ErrUserNotFound, buyerEmail)
+			}
+
+			return fmt.Errorf("cannot get id of the user (email = %v); err: %w", buyerEmail, err)
+		}
+
+		if err := requireDifferentUsers(sellerID, buyerID); err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		_, err = transfer(ctx, tx, LedgerOperationTrade, sellerID, buyerID, currency, value)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot commit transaction; err: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// GetUserCurrencyAmount works as GetUserMoney but returns defaultAmount instead of pgx.ErrNoRows
+// when the user has no row for the currency.
+func (pc *postgresClient) GetUserCurrencyAmount(ctx context.Context, userID uint64, currency string, defaultAmount float64) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	amount := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COALESCE(
+			(SELECT amount
+			 FROM users_money
+			 WHERE user_id = $1
+			 AND currency = $2),
+			$3
+		 )`,
+		userID,
+		currency,
+		defaultAmount,
+	).Scan(&amount)
+
+	if err != nil {
+		return 0, fmt.Errorf("postgres cannot scan user's (id = %v) amount of the currency (%v); err: %v", userID, currency, err)
+	}
+
+	return amount, nil
+}
+
+// GetUnheldCurrencies returns currencies nobody holds a non-zero amount of
+func (pc *postgresClient) GetUnheldCurrencies(ctx context.Context) ([]string, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT c.currency
+		 FROM currencies c
+		 WHERE NOT EXISTS (
+			SELECT 1
+			FROM users_money um
+			WHERE um.currency = c.currency
+			AND um.amount <> 0
+		 )
+		 ORDER BY c.currency`,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get unheld currencies; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		var currency string
+		err = rows.Scan(&currency)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan unheld currency; err: %v", err)
+		}
+
+		res = append(res, currency)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get unheld currencies; err: %v", rows.Err())
+	}
+
+	return res, nil
+}
+
+// NormalizeCurrencyCodes upper-cases currency codes stored before the codes were normalized on write.
+// Balances (with their reservations), balance snapshots and trade volumes in differently cased codes are summed up;
+// if a currency exists in several casings, the upper-cased row (or the first of the others in order) is kept
+// with all its settings. The ledger and the currency history are upper-cased in place.
+func (pc *postgresClient) NormalizeCurrencyCodes(ctx context.Context) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	queries := []string{
+		`INSERT INTO currencies (currency, value, version, min_balance, trading_halted)
+		 SELECT DISTINCT ON (UPPER(currency)) UPPER(currency), value, version, min_balance, trading_halted
+		 FROM currencies
+		 WHERE currency <> UPPER(currency)
+		 ORDER BY UPPER(currency), currency
+		 ON CONFLICT (currency) DO NOTHING`,
+		`DELETE FROM currencies
+		 WHERE currency <> UPPER(currency)`,
+		`INSERT INTO users_money (user_id, currency, amount, reserved)
+		 SELECT user_id, UPPER(currency), SUM(amount), SUM(reserved)
+		 FROM users_money
+		 WHERE currency <> UPPER(currency)
+		 GROUP BY user_id, UPPER(currency)
+		 ON CONFLICT (user_id, currency)
+		 DO UPDATE
+		 SET amount = users_money.amount + EXCLUDED.amount,
+			reserved = users_money.reserved + EXCLUDED.reserved`,
+		`DELETE FROM users_money
+		 WHERE currency <> UPPER(currency)`,
+		`INSERT INTO balance_snapshots (snapshot_date, user_id, currency, amount)
+		 SELECT snapshot_date, user_id, UPPER(currency), SUM(amount)
+		 FROM balance_snapshots
+		 WHERE currency <> UPPER(currency)
+		 GROUP BY snapshot_date, user_id, UPPER(currency)
+		 ON CONFLICT (user_id, currency, snapshot_date)
+		 DO UPDATE
+		 SET amount = balance_snapshots.amount + EXCLUDED.amount`,
+		`DELETE FROM balance_snapshots
+		 WHERE currency <> UPPER(currency)`,
+		`INSERT INTO currency_stats (currency, total_volume)
+		 SELECT UPPER(currency), SUM(total_volume)
+		 FROM currency_stats
+		 WHERE currency <> UPPER(currency)
+		 GROUP BY UPPER(currency)
+		 ON CONFLICT (currency)
+		 DO UPDATE
+		 SET total_volume = currency_stats.total_volume + EXCLUDED.total_volume`,
+		`DELETE FROM currency_stats
+		 WHERE currency <> UPPER(currency)`,
+		`UPDATE currency_history
+		 SET currency = UPPER(currency)
+		 WHERE currency <> UPPER(currency)`,
+		`UPDATE ledger
+		 SET currency = UPPER(currency)
+		 WHERE currency <> UPPER(currency)`,
+	}
+
+	for _, query := range queries {
+		_, err = tx.Exec(ctx, query)
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot normalize currency codes; err: %v", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	pc.currencies.invalidate(pc.tenant(ctx))
+
+	return nil
+}
+
+// CheckSchemaVersion returns ErrSchemaMismatch if the latest applied migration is not the expected one
+// (usually SchemaVersion).
+func (pc *postgresClient) CheckSchemaVersion(ctx context.Context, expected int) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	version := 0
+	err := pc.connection.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("cannot get schema version; err: %v", err)
+	}
+
+	if version != expected {
+		return fmt.Errorf("%w; database is at version %v, expected %v", ErrSchemaMismatch, version, expected)
+	}
+
+	return nil
+}
+
+// SendCurrencies sends several currencies from the seller to the buyer in one transaction.
+// Nothing is sent if the seller does not have enough of any of the currencies.
+// The trades form a batch identified by the ledger id of its first trade, see ReverseBatch.
+func (pc *postgresClient) SendCurrencies(ctx context.Context, sellerID, buyerID uint64, amounts map[string]float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireDifferentUsers(sellerID, buyerID); err != nil {
+		return err
+	}
+
+	if err := pc.allow(sendRateLimitKey(sellerID)); err != nil {
+		return err
+	}
+
+	// the same order of the locks for every basket
+	currencies := make([]string, 0, len(amounts))
+	for currency := range amounts {
+		currencies = append(currencies, currency)
+	}
+
+	sort.Strings(currencies)
+
+	return retryOnTxConflict(ctx, func() error {
+		tx, err := pc.connection.BeginTx(ctx, pc.settings.SendCurrencyTxOptions)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction; err %w", err)
+		}
+
+		for _, currency := range currencies {
+			value := amounts[currency]
+			amount := float64(0)
+
+			err = tx.QueryRow(
+				ctx,
+				`SELECT amount
+				 FROM users_money
+				 WHERE user_id = $1
+				 AND currency = $2
+				 FOR UPDATE`,
+				sellerID,
+				normalizeCurrency(currency),
+			).Scan(&amount)
+
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				tx.Rollback(ctx)
+				return fmt.Errorf("cannot get user's (id = %v) amount of the currency (%v); err: %w", sellerID, currency, err)
+			}
+
+			if amount < value {
+				tx.Rollback(ctx)
+				return fmt.Errorf("%w; user with id %v does not have %v %v", ErrInsufficientFunds, sellerID, value, currency)
+			}
+		}
+
+		batchID := uint64(0)
+		for _, currency := range currencies {
+			tradeID, err := transfer(ctx, tx, LedgerOperationTrade, sellerID, buyerID, currency, amounts[currency])
+			if err != nil {
+				tx.Rollback(ctx)
+				return err
+			}
+
+			if batchID == 0 {
+				batchID = tradeID
+			}
+
+			_, err = tx.Exec(ctx, "UPDATE ledger SET batch_id = $1 WHERE id = $2", batchID, tradeID)
+			if err != nil {
+				tx.Rollback(ctx)
+				return fmt.Errorf("cannot add trade (id = %v) to the batch (id = %v); err: %w", tradeID, batchID, err)
+			}
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot commit transaction; err: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// GetUserRank returns the position of the user among all the users by the value of their holdings
+// (1 is the richest) and the number of users.
+func (pc *postgresClient) GetUserRank(ctx context.Context, userID uint64) (int, int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, 0, err
+	}
+
+	rank, total := 0, 0
+	err := pc.connection.QueryRow(
+		ctx,
+		`WITH worth AS (
+			SELECT u.id, COALESCE(SUM(um.amount * c.value), 0) AS value
+			FROM users u
+			LEFT JOIN users_money um ON um.user_id = u.id
+			LEFT JOIN currencies c ON c.currency = um.currency
+			WHERE u.deleted_at IS NULL
+			GROUP BY u.id
+		 ), ranked AS (
+			SELECT id, RANK() OVER (ORDER BY value DESC) AS rank, COUNT(*) OVER () AS total
+			FROM worth
+		 )
+		 SELECT rank, total
+		 FROM ranked
+		 WHERE id = $1`,
+		userID,
+	).Scan(&rank, &total)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, 0, fmt.Errorf("%w; user id %v", ErrUserNotFound, userID)
+		}
+
+		return 0, 0, fmt.Errorf("cannot get user's (id = %v) rank; err: %v", userID, err)
+	}
+
+	return rank, total, nil
+}
+
+// AdminSetBalance sets the user's amount of the currency to newAmount and writes an adjustment
+// with the previous amount, the admin and the reason to the ledger. A negative newAmount fails with ErrInvalidArgument.
+func (pc *postgresClient) AdminSetBalance(ctx context.Context, adminID, userID uint64, currency string, newAmount float64, reason string) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("reason", reason); err != nil {
+		return err
+	}
+
+	if newAmount < 0 {
+		return fmt.Errorf("%w; cannot set a negative balance %v %v of the user (id = %v)", ErrInvalidArgument, newAmount, currency, userID)
+	}
+
+	currency = normalizeCurrency(currency)
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	oldAmount := float64(0)
+	err = tx.QueryRow(
+		ctx,
+		`SELECT amount
+		 FROM users_money
+		 WHERE user_id = $1
+		 AND currency = $2
+		 FOR UPDATE`,
+		userID,
+		currency,
+	).Scan(&oldAmount)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot get user's (id = %v) amount of the currency (%v); err: %v", userID, currency, err)
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO users_money (amount, user_id, currency)
+		 VALUES($1, $2, $3)
+		 ON CONFLICT (user_id, currency)
+		 DO UPDATE
+		 SET amount = EXCLUDED.amount`,
+		newAmount,
+		userID,
+		currency,
+	)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot update user's (id = %v) currency (%v); err: %v", userID, currency, err)
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO ledger (operation, buyer_id, currency, amount, actor_id, previous_amount, reason)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		LedgerOperationAdjustment,
+		userID,
+		currency,
+		newAmount-oldAmount,
+		adminID,
+		oldAmount,
+		reason,
+	)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot write adjustment of the user's (id = %v) currency (%v) to the ledger; err: %v", userID, currency, err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return nil
+}
+
+// GetCurrencyHolders returns ids of all the users that hold a positive amount of the currency
+func (pc *postgresClient) GetCurrencyHolders(ctx context.Context, currency string) ([]uint64, error) {
+	return pc.GetCurrencyHoldersPage(ctx, currency, 0, 0)
+}
+
+// GetCurrencyHoldersPage works as GetCurrencyHolders but returns up to limit holders (ordered by id)
+// starting from the offset; limit 0 means no limit.
+func (pc *postgresClient) GetCurrencyHoldersPage(ctx context.Context, currency string, limit, offset int) ([]uint64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT DISTINCT user_id
+		 FROM users_money
+		 WHERE currency = $1
+		 AND amount > 0
+		 ORDER BY user_id
+		 LIMIT NULLIF($2, 0)
+		 OFFSET $3`,
+		currency,
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get holders of the currency %v; err: %v", currency, err)
+	}
+
+	defer rows.Close()
+
+	ids := []uint64{}
+	for rows.Next() {
+		var id uint64
+		err = rows.Scan(&id)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan holder of the currency %v; err: %v", currency, err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get holders of the currency %v; err: %v", currency, rows.Err())
+	}
+
+	return ids, nil
+}
+
+// GetMarketCaps returns the supply and market cap of every currency sorted by market cap descending;
+// currencies nobody holds have zero supply and market cap.
+func (pc *postgresClient) GetMarketCaps(ctx context.Context) ([]MarketCap, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT c.currency, COALESCE(s.supply, 0), c.value, COALESCE(s.supply, 0) * c.value AS market_cap
+		 FROM currencies c
+		 LEFT JOIN (
+			SELECT currency, SUM(amount) AS supply
+			FROM users_money
+			GROUP BY currency
+		 ) s ON s.currency = c.currency
+		 ORDER BY market_cap DESC, c.currency`,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get market caps; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	caps := []MarketCap{}
+	for rows.Next() {
+		marketCap := MarketCap{}
+		err = rows.Scan(&marketCap.Currency, &marketCap.Supply, &marketCap.Value, &marketCap.MarketCap)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan market cap; err: %v", err)
+		}
+
+		caps = append(caps, marketCap)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get market caps; err: %v", rows.Err())
+	}
+
+	return caps, nil
+}
+
+// MergeUsers moves all the holdings (with their reserved parts) and ledger entries of the source user to the target user
+// and soft-deletes the source user. A deleted user is skipped by the listings and the lookups by email
+// and its email can be registered again.
+func (pc *postgresClient) MergeUsers(ctx context.Context, sourceID, targetID uint64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if sourceID == targetID {
+		return fmt.Errorf("%w; cannot merge user (id = %v) into itself", ErrInvalidArgument, sourceID)
+	}
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	found := 0
+	err = tx.QueryRow(
+		ctx,
+		`SELECT COUNT(*)
+		 FROM (
+			SELECT id
+			FROM users
+			WHERE id IN ($1, $2)
+			AND deleted_at IS NULL
+			FOR UPDATE
+		 ) u`,
+		sourceID,
+		targetID,
+	).Scan(&found)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot lock users (id = %v, %v); err: %v", sourceID, targetID, err)
+	}
+
+	if found != 2 {
+		tx.Rollback(ctx)
+		return fmt.Errorf("%w; user id %v or %v", ErrUserNotFound, sourceID, targetID)
+	}
+
+	moves := []struct {
+		query string
+		args  []interface{}
+	}{
+		{
+			`INSERT INTO users_money (user_id, currency, amount, reserved)
+			 SELECT $2, currency, amount, reserved
+			 FROM users_money
+			 WHERE user_id = $1
+			 ON CONFLICT (user_id, currency)
+			 DO UPDATE
+			 SET amount = users_money.amount + EXCLUDED.amount,
+				reserved = users_money.reserved + EXCLUDED.reserved`,
+			[]interface{}{sourceID, targetID},
+		},
+		{"DELETE FROM users_money WHERE user_id = $1", []interface{}{sourceID}},
+		{"UPDATE ledger SET seller_id = $2 WHERE seller_id = $1", []interface{}{sourceID, targetID}},
+		{"UPDATE ledger SET buyer_id = $2 WHERE buyer_id = $1", []interface{}{sourceID, targetID}},
+		{"UPDATE users SET deleted_at = NOW() WHERE id = $1", []interface{}{sourceID}},
+	}
+
+	for _, move := range moves {
+		_, err = tx.Exec(ctx, move.query, move.args...)
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot merge user (id = %v) into user (id = %v); err: %v", sourceID, targetID, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return nil
+}
+
+// GetTradeCountsByCurrency returns the number of trades of every currency traded since the given time
+func (pc *postgresClient) GetTradeCountsByCurrency(ctx context.Context, since time.Time) (map[string]int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT currency, COUNT(*)
+		 FROM ledger
+		 WHERE operation = $1
+		 AND created_at >= $2
+		 GROUP BY currency`,
+		LedgerOperationTrade,
+		since,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get trade counts since %v; err: %v", since, err)
+	}
+
+	defer rows.Close()
+
+	res := make(map[string]int)
+	for rows.Next() {
+		var currency string
+		var count int
+		err = rows.Scan(&currency, &count)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan trade count; err: %v", err)
+		}
+
+		res[currency] = count
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get trade counts since %v; err: %v", since, rows.Err())
+	}
+
+	return res, nil
+}
+
+// GetCurrenciesWithSupply returns every currency with its value and total supply in one round-trip
+// instead of GetCurrencies followed by GetCurrencyAmount per currency.
+func (pc *postgresClient) GetCurrenciesWithSupply(ctx context.Context) ([]CurrencyInfo, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT c.currency, c.value, COALESCE(SUM(um.amount), 0)
+		 FROM currencies c
+		 LEFT JOIN users_money um ON um.currency = c.currency
+		 GROUP BY c.currency, c.value
+		 ORDER BY c.currency`,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get currencies with supply; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	currencies := []CurrencyInfo{}
+	for rows.Next() {
+		info := CurrencyInfo{}
+		err = rows.Scan(&info.Currency, &info.Value, &info.Supply)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan currency with supply; err: %v", err)
+		}
+
+		currencies = append(currencies, info)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get currencies with supply; err: %v", rows.Err())
+	}
+
+	return currencies, nil
+}
+
+// FindOrphanBalances returns balances of the currencies that do not exist anymore
+func (pc *postgresClient) FindOrphanBalances(ctx context.Context) ([]OrphanBalance, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT um.user_id, um.currency, um.amount
+		 FROM users_money um
+		 WHERE NOT EXISTS (
+			SELECT 1
+			FROM currencies c
+			WHERE c.currency = um.currency
+		 )
+		 ORDER BY um.user_id, um.currency`,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get orphan balances; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	balances := []OrphanBalance{}
+	for rows.Next() {
+		balance := OrphanBalance{}
+		err = rows.Scan(&balance.UserID, &balance.Currency, &balance.Amount)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan orphan balance; err: %v", err)
+		}
+
+		balances = append(balances, balance)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get orphan balances; err: %v", rows.Err())
+	}
+
+	return balances, nil
+}
+
+// GetLargestHolding returns the currency the user holds the most of and its amount;
+// returns ErrNoHoldings if the user holds nothing.
+func (pc *postgresClient) GetLargestHolding(ctx context.Context, userID uint64) (string, float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return "", 0, err
+	}
+
+	currency := ""
+	amount := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT currency, amount
+		 FROM users_money
+		 WHERE user_id = $1
+		 AND amount > 0
+		 ORDER BY amount DESC, currency
+		 LIMIT 1`,
+		userID,
+	).Scan(&currency, &amount)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", 0, fmt.Errorf("%w; user id %v", ErrNoHoldings, userID)
+		}
+
+		return "", 0, fmt.Errorf("cannot get user's (id = %v) largest holding; err: %v", userID, err)
+	}
+
+	return currency, amount, nil
+}
+
+// CreateCurrency lists a new currency; if value is nil the currency gets the DefaultCurrencyValue (1.0 if it is not set).
+// Returns ErrCurrencyExists if the currency is already listed.
+func (pc *postgresClient) CreateCurrency(ctx context.Context, currency string, value *float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	currencyValue := pc.settings.DefaultCurrencyValue
+	if currencyValue == 0 {
+		currencyValue = 1
+	}
+
+	if value != nil {
+		currencyValue = *value
+	}
+
+	tag, err := pc.connection.Exec(
+		ctx,
+		`WITH created AS (
+			INSERT INTO currencies (currency, value)
+			VALUES ($1, $2)
+			ON CONFLICT (currency) DO NOTHING
+			RETURNING currency, value
+		 )
+		 INSERT INTO currency_history (currency, value)
+		 SELECT currency, value
+		 FROM created`,
+		currency,
+		currencyValue,
+	)
+
+	if err != nil {
+		return fmt.Errorf("cannot create currency %v with value %v; err: %v", currency, currencyValue, err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w; currency %v", ErrCurrencyExists, currency)
+	}
+
+	pc.currencies.invalidate(pc.tenant(ctx))
+
+	return nil
+}
+
+// GetUsersByIDs returns emails of the users by their ids; ids of non-existent users are skipped
+func (pc *postgresClient) GetUsersByIDs(ctx context.Context, ids []uint64) (map[uint64]string, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	res := make(map[uint64]string, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+
+	userIDs := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		userIDs = append(userIDs, int64(id))
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT id, email
+		 FROM users
+		 WHERE id = ANY($1)
+		 AND deleted_at IS NULL`,
+		userIDs,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get users by ids; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint64
+		var email string
+		err = rows.Scan(&id, &email)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user from the postgres database; err: %v", err)
+		}
+
+		res[id] = email
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get users by ids; err: %v", rows.Err())
+	}
+
+	return res, nil
+}
+
+// SnapshotBalances copies every balance into balance_snapshots under today's date.
+// Only the first snapshot of a day is kept, so running it several times a day changes nothing.
+func (pc *postgresClient) SnapshotBalances(ctx context.Context) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	_, err := pc.connection.Exec(
+		ctx,
+		`INSERT INTO balance_snapshots (snapshot_date, user_id, currency, amount)
+		 SELECT CURRENT_DATE, user_id, currency, amount
+		 FROM users_money
+		 ON CONFLICT (user_id, currency, snapshot_date) DO NOTHING`,
+	)
+
+	if err != nil {
+		return fmt.Errorf("cannot snapshot balances; err: %v", err)
+	}
+
+	return nil
+}
+
+// GetUserBalanceHistory returns the daily snapshots of the user's balance of the currency within [from, to], oldest first
+func (pc *postgresClient) GetUserBalanceHistory(ctx context.Context, userID uint64, currency string, from, to time.Time) ([]BalanceSnapshot, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT snapshot_date, amount
+		 FROM balance_snapshots
+		 WHERE user_id = $1
+		 AND currency = $2
+		 AND snapshot_date BETWEEN $3::date AND $4::date
+		 ORDER BY snapshot_date`,
+		userID,
+		currency,
+		from,
+		to,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get user's (id = %v) balance history of the currency (%v); err: %v", userID, currency, err)
+	}
+
+	defer rows.Close()
+
+	history := []BalanceSnapshot{}
+	for rows.Next() {
+		snapshot := BalanceSnapshot{}
+		err = rows.Scan(&snapshot.Date, &snapshot.Amount)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user's (id = %v) balance snapshot; err: %v", userID, err)
+		}
+
+		history = append(history, snapshot)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get user's (id = %v) balance history of the currency (%v); err: %v", userID, currency, rows.Err())
+	}
+
+	return history, nil
+}
+
+// ReverseBatch refunds every trade of the batch sent by SendCurrencies in one transaction.
+// Nothing is refunded if any of the buyers does not hold the received amount anymore
+// or if any of the trades was already refunded.
+func (pc *postgresClient) ReverseBatch(ctx context.Context, batchID uint64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`SELECT id, seller_id, buyer_id, currency, amount
+		 FROM ledger
+		 WHERE batch_id = $1
+		 AND operation = $2
+		 ORDER BY id
+		 FOR UPDATE`,
+		batchID,
+		LedgerOperationTrade,
+	)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot get trades of the batch (id = %v); err: %v", batchID, err)
+	}
+
+	trades := []Trade{}
+	for rows.Next() {
+		trade := Trade{}
+		err = rows.Scan(&trade.ID, &trade.SellerID, &trade.BuyerID, &trade.Currency, &trade.Amount)
+
+		if err != nil {
+			rows.Close()
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot scan trade of the batch (id = %v); err: %v", batchID, err)
+		}
+
+		trades = append(trades, trade)
+	}
+
+	if rows.Err() != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot get trades of the batch (id = %v); err: %v", batchID, rows.Err())
+	}
+
+	if len(trades) == 0 {
+		tx.Rollback(ctx)
+		return fmt.Errorf("%w; batch id %v", ErrTradeNotFound, batchID)
+	}
+
+	refunded := false
+	err = tx.QueryRow(
+		ctx,
+		`SELECT EXISTS(
+			SELECT 1
+			FROM ledger r
+			JOIN ledger t ON t.id = r.reference_id
+			WHERE t.batch_id = $1
+			AND r.operation = $2
+		 )`,
+		batchID,
+		LedgerOperationRefund,
+	).Scan(&refunded)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot check whether batch (id = %v) was refunded; err: %v", batchID, err)
+	}
+
+	if refunded {
+		tx.Rollback(ctx)
+		return fmt.Errorf("%w; batch id %v", ErrTradeAlreadyRefunded, batchID)
+	}
+
+	for _, trade := range trades {
+		amount := float64(0)
+		err = tx.QueryRow(
+			ctx,
+			`SELECT amount
+			 FROM users_money
+			 WHERE user_id = $1
+			 AND currency = $2
+			 FOR UPDATE`,
+			trade.BuyerID,
+			trade.Currency,
+		).Scan(&amount)
+
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot get user's (id = %v) amount of the currency (%v); err: %v", trade.BuyerID, trade.Currency, err)
+		}
+
+		// the previous refunds of the batch have already been subtracted
+		if amount < trade.Amount {
+			tx.Rollback(ctx)
+			return fmt.Errorf("%w; user with id %v does not have %v %v anymore", ErrInsufficientFunds, trade.BuyerID, trade.Amount, trade.Currency)
+		}
+
+		refundID, err := transfer(ctx, tx, LedgerOperationRefund, trade.BuyerID, trade.SellerID, trade.Currency, trade.Amount)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE ledger SET reference_id = $1 WHERE id = $2", trade.ID, refundID)
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot link refund to the trade (id = %v); err: %v", trade.ID, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	return nil
+}
+
+// GetCurrenciesByPopularity returns up to limit currencies with the number of their holders, most held first;
+// limit 0 means no limit. Currencies nobody holds are returned at the bottom only if includeUnheld is set.
+func (pc *postgresClient) GetCurrenciesByPopularity(ctx context.Context, limit int, includeUnheld bool) ([]CurrencyPopularity, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT c.currency, COUNT(DISTINCT um.user_id) AS holders
+		 FROM currencies c
+		 LEFT JOIN users_money um ON um.currency = c.currency AND um.amount > 0
+		 GROUP BY c.currency
+		 HAVING $1 OR COUNT(um.user_id) > 0
+		 ORDER BY holders DESC, c.currency
+		 LIMIT NULLIF($2, 0)`,
+		includeUnheld,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get currencies by popularity; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	res := []CurrencyPopularity{}
+	for rows.Next() {
+		popularity := CurrencyPopularity{}
+		err = rows.Scan(&popularity.Currency, &popularity.Holders)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan currency popularity; err: %v", err)
+		}
+
+		res = append(res, popularity)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get currencies by popularity; err: %v", rows.Err())
+	}
+
+	return res, nil
+}
+
+// GetTradesBetween returns up to limit latest trades between the two users in both directions, newest first.
+// Direction of every trade is relative to userA.
+func (pc *postgresClient) GetTradesBetween(ctx context.Context, userA, userB uint64, limit int) ([]Trade, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT id, seller_id, buyer_id, currency, amount, created_at
+		 FROM ledger
+		 WHERE operation = $1
+		 AND (
+			(seller_id = $2 AND buyer_id = $3)
+			OR (seller_id = $3 AND buyer_id = $2)
+		 )
+		 ORDER BY created_at DESC
+		 LIMIT $4`,
+		LedgerOperationTrade,
+		userA,
+		userB,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get trades between users (id = %v, %v); err: %v", userA, userB, err)
+	}
+
+	defer rows.Close()
+
+	trades := []Trade{}
+	for rows.Next() {
+		trade := Trade{}
+		err = rows.Scan(&trade.ID, &trade.SellerID, &trade.BuyerID, &trade.Currency, &trade.Amount, &trade.CreatedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan trade from the postgres database; err: %v", err)
+		}
+
+		trade.Direction = TradeDirectionReceived
+		if trade.SellerID == userA {
+			trade.Direction = TradeDirectionSent
+		}
+
+		trades = append(trades, trade)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get trades between users (id = %v, %v); err: %v", userA, userB, rows.Err())
+	}
+
+	return trades, nil
+}
+
+// StreamCurrencyHolders works as GetCurrencyHolders but calls fn for every holder instead of collecting them,
+// so the memory usage does not depend on the number of holders. Stops at the first error of fn and returns it.
+func (pc *postgresClient) StreamCurrencyHolders(ctx context.Context, currency string, fn func(userID uint64) error) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	return pc.streamCursor(
+		ctx,
+		`SELECT DISTINCT user_id
+		 FROM users_money
+		 WHERE currency = $1
+		 AND amount > 0
+		 ORDER BY user_id`,
+		[]interface{}{currency},
+		func(rows pgx.Rows) error {
+			var userID uint64
+			err := rows.Scan(&userID)
+
+			if err != nil {
+				return fmt.Errorf("cannot scan holder of the currency %v; err: %v", currency, err)
+			}
+
+			return fn(userID)
+		},
+	)
+}
+
+// StreamBalances calls fn for every balance of every user ordered by user and currency.
+// Stops at the first error of fn and returns it.
+func (pc *postgresClient) StreamBalances(ctx context.Context, fn func(balance Balance) error) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	return pc.streamCursor(
+		ctx,
+		`SELECT user_id, currency, amount
+		 FROM users_money
+		 ORDER BY user_id, currency`,
+		nil,
+		func(rows pgx.Rows) error {
+			balance := Balance{}
+			err := rows.Scan(&balance.UserID, &balance.Currency, &balance.Amount)
+
+			if err != nil {
+				return fmt.Errorf("cannot scan balance; err: %v", err)
+			}
+
+			return fn(balance)
+		},
+	)
+}
+
+// SetCurrencyHalted halts or resumes trading of the currency
+func (pc *postgresClient) SetCurrencyHalted(ctx context.Context, currency string, halted bool) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	tag, err := pc.connection.Exec(
+		ctx,
+		`UPDATE currencies
+		 SET trading_halted = $1
+		 WHERE currency = $2`,
+		halted,
+		currency,
+	)
+
+	if err != nil {
+		return fmt.Errorf("cannot set trading halted = %v for the currency %v; err: %v", halted, currency, err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+	}
+
+	return nil
+}
+
+// GetUserNetFlow returns how much of the currency the user received and sent within [from, to)
+// by transfers between users (trades, fees and refunds).
+func (pc *postgresClient) GetUserNetFlow(ctx context.Context, userID uint64, currency string, from, to time.Time) (float64, float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	in, out := float64(0), float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT
+			COALESCE(SUM(amount) FILTER (WHERE buyer_id = $1), 0),
+			COALESCE(SUM(amount) FILTER (WHERE seller_id = $1), 0)
+		 FROM ledger
+		 WHERE operation IN ($2, $3, $4)
+		 AND (seller_id = $1 OR buyer_id = $1)
+		 AND currency = $5
+		 AND created_at >= $6
+		 AND created_at < $7`,
+		userID,
+		LedgerOperationTrade,
+		LedgerOperationFee,
+		LedgerOperationRefund,
+		currency,
+		from,
+		to,
+	).Scan(&in, &out)
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot get user's (id = %v) flow of the currency (%v); err: %v", userID, currency, err)
+	}
+
+	return in, out, nil
+}
+
+// PruneLedger deletes ledger entries created before olderThan and returns how many were deleted.
+// Everything computed from the ledger (trade volumes, flows, refunds...) forgets the pruned period:
+// pruned trades cannot be refunded and refunds lose the link to the pruned trades.
+// Rows are deleted in batches to keep the locks short; it is safe to run repeatedly.
+func (pc *postgresClient) PruneLedger(ctx context.Context, olderThan time.Time) (int64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	return pc.pruneInBatches(ctx, "ledger", "created_at", olderThan)
+}
+
+// PruneCurrencyHistory deletes currency_history rows changed before olderThan and returns how many were deleted.
+// Historical rates of the pruned period are lost. Rows are deleted in batches; it is safe to run repeatedly.
+func (pc *postgresClient) PruneCurrencyHistory(ctx context.Context, olderThan time.Time) (int64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	return pc.pruneInBatches(ctx, "currency_history", "changed_at", olderThan)
+}
+
+// pruneBatchSize is how many rows are deleted by a single statement of pruneInBatches
+const pruneBatchSize = 1000
+
+// pruneInBatches deletes rows of the table whose timeColumn is before olderThan, pruneBatchSize rows at a time
+func (pc *postgresClient) pruneInBatches(ctx context.Context, table, timeColumn string, olderThan time.Time) (int64, error) {
+	query := fmt.Sprintf(
+		`DELETE FROM %[1]s
+		 WHERE id IN (
+			SELECT id
+			FROM %[1]s
+			WHERE %[2]s < $1
+			LIMIT $2
+		 )`,
+		table,
+		timeColumn,
+	)
+
+	deleted := int64(0)
+	for {
+		tag, err := pc.connection.Exec(ctx, query, olderThan, pruneBatchSize)
+		if err != nil {
+			return deleted, fmt.Errorf("cannot prune %v older than %v; err: %v", table, olderThan, err)
+		}
+
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < pruneBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// GetCirculatingSupply returns the total supply of the currency, the part of it held by the treasury users
+// and the circulating rest.
+func (pc *postgresClient) GetCirculatingSupply(ctx context.Context, currency string) (float64, float64, float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, 0, 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, 0, 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	total, treasury := float64(0), float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT
+			COALESCE(SUM(um.amount), 0),
+			COALESCE(SUM(um.amount) FILTER (WHERE u.treasury), 0)
+		 FROM users_money um
+		 JOIN users u ON u.id = um.user_id
+		 WHERE um.currency = $1`,
+		currency,
+	).Scan(&total, &treasury)
+
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("cannot get circulating supply of the currency %v; err: %v", currency, err)
+	}
+
+	return total, treasury, total - treasury, nil
+}
+
+// LaunchCurrency creates the currency and credits the initial allocations (user id -> amount) in one transaction.
+// Nothing is created if any allocation references an unknown user; negative allocations fail with ErrInvalidArgument.
+func (pc *postgresClient) LaunchCurrency(ctx context.Context, currency string, value float64, allocations map[uint64]float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	for userID, amount := range allocations {
+		if amount < 0 {
+			return fmt.Errorf("%w; cannot allocate a negative amount %v %v to the user (id = %v)", ErrInvalidArgument, amount, currency, userID)
+		}
+	}
+
+	currency = normalizeCurrency(currency)
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	tag, err := tx.Exec(
+		ctx,
+		`WITH created AS (
+			INSERT INTO currencies (currency, value)
+			VALUES ($1, $2)
+			ON CONFLICT (currency) DO NOTHING
+			RETURNING currency, value
+		 )
+		 INSERT INTO currency_history (currency, value)
+		 SELECT currency, value
+		 FROM created`,
+		currency,
+		value,
+	)
+
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("cannot create currency %v with value %v; err: %v", currency, value, err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		tx.Rollback(ctx)
+		return fmt.Errorf("%w; currency %v", ErrCurrencyExists, currency)
+	}
+
+	for userID, amount := range allocations {
+		exists := false
+		err = tx.QueryRow(
+			ctx,
+			"SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL)",
+			userID,
+		).Scan(&exists)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot check whether user (id = %v) exists; err: %v", userID, err)
+		}
+
+		if !exists {
+			tx.Rollback(ctx)
+			return fmt.Errorf("%w; user id %v", ErrUserNotFound, userID)
+		}
+
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO users_money (user_id, currency, amount)
+			 VALUES ($1, $2, $3)`,
+			userID,
+			currency,
+			amount,
+		)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot allocate %v %v to the user (id = %v); err: %v", amount, currency, userID, err)
+		}
+
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO ledger (operation, buyer_id, currency, amount)
+			 VALUES ($1, $2, $3, $4)`,
+			LedgerOperationCredit,
+			userID,
+			currency,
+			amount,
+		)
+
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot write allocation of the user (id = %v) to the ledger; err: %v", userID, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %v", err)
+	}
+
+	pc.currencies.invalidate(pc.tenant(ctx))
+
+	return nil
+}
+
+// GetCostBasis returns the volume-weighted average price the user bought the currency at.
+// Returns ErrNoTrades if the user never bought it (trades recorded before prices were stored are ignored).
+func (pc *postgresClient) GetCostBasis(ctx context.Context, userID uint64, currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	var avgCost *float64
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT SUM(amount * price) / NULLIF(SUM(amount), 0)
+		 FROM ledger
+		 WHERE operation = $1
+		 AND buyer_id = $2
+		 AND currency = $3
+		 AND price IS NOT NULL`,
+		LedgerOperationTrade,
+		userID,
+		currency,
+	).Scan(&avgCost)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get user's (id = %v) cost basis of the currency (%v); err: %v", userID, currency, err)
+	}
+
+	if avgCost == nil {
+		return 0, fmt.Errorf("%w; user id %v, currency %v", ErrNoTrades, userID, currency)
+	}
+
+	return *avgCost, nil
+}
+
+// HaveTraded reports whether the two users have ever traded with each other in either direction.
+func (pc *postgresClient) HaveTraded(ctx context.Context, userA, userB uint64) (bool, error) {
+	if err := pc.checkClosed(); err != nil {
+		return false, err
+	}
+
+	traded := false
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT EXISTS(
+			SELECT 1
+			FROM ledger
+			WHERE operation = $1
+			AND (
+				(seller_id = $2 AND buyer_id = $3)
+				OR (seller_id = $3 AND buyer_id = $2)
+			)
+		 )`,
+		LedgerOperationTrade,
+		userA,
+		userB,
+	).Scan(&traded)
+
+	if err != nil {
+		return false, fmt.Errorf("cannot check whether users (id = %v, %v) have traded; err: %v", userA, userB, err)
+	}
+
+	return traded, nil
+}
+
+// SendAllCurrency transfers the seller's balance of the currency above its min_balance to the buyer and returns the sent amount;
+// the seller keeps the min_balance, so the sweep does not fail with ErrBelowMinimumBalance.
+// The balance is read under a row lock, so it cannot change between reading and sending.
+// Returns ErrNoHoldings if the seller holds no more than the min_balance of the currency.
+func (pc *postgresClient) SendAllCurrency(ctx context.Context, sellerID, buyerID uint64, currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireDifferentUsers(sellerID, buyerID); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	if err := pc.allow(sendRateLimitKey(sellerID)); err != nil {
+		return 0, err
+	}
+
+	sent := float64(0)
+	err := retryOnTxConflict(ctx, func() error {
+		tx, err := pc.connection.BeginTx(ctx, pc.settings.SendCurrencyTxOptions)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction; err %w", err)
+		}
+
+		amount := float64(0)
+		err = tx.QueryRow(
+			ctx,
+			`SELECT amount
+			 FROM users_money
+			 WHERE user_id = $1
+			 AND currency = $2
+			 FOR UPDATE`,
+			sellerID,
+			currency,
+		).Scan(&amount)
+
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot get user's (id = %v) amount of the currency (%v); err: %w", sellerID, currency, err)
+		}
+
+		minBalance := float64(0)
+		err = tx.QueryRow(
+			ctx,
+			`SELECT min_balance
+			 FROM currencies
+			 WHERE currency = $1`,
+			currency,
+		).Scan(&minBalance)
+
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot get min balance of the currency %v; err: %w", currency, err)
+		}
+
+		if amount <= minBalance {
+			tx.Rollback(ctx)
+			return fmt.Errorf("%w; user id %v, currency %v", ErrNoHoldings, sellerID, currency)
+		}
+
+		_, err = transfer(ctx, tx, LedgerOperationTrade, sellerID, buyerID, currency, amount-minBalance)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot commit transaction; err: %w", err)
+		}
+
+		sent = amount - minBalance
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return sent, nil
+}
+
+// GetLastTradeTime returns the time of the latest trade the user took part in as a seller or a buyer.
+// Returns zero time and ErrNoTrades if the user has never traded.
+func (pc *postgresClient) GetLastTradeTime(ctx context.Context, userID uint64) (time.Time, error) {
+	if err := pc.checkClosed(); err != nil {
+		return time.Time{}, err
+	}
+
+	var lastTrade *time.Time
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT MAX(created_at)
+		 FROM ledger
+		 WHERE operation = $1
+		 AND (seller_id = $2 OR buyer_id = $2)`,
+		LedgerOperationTrade,
+		userID,
+	).Scan(&lastTrade)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot get user's (id = %v) last trade time; err: %v", userID, err)
+	}
+
+	if lastTrade == nil {
+		return time.Time{}, fmt.Errorf("%w; user id %v", ErrNoTrades, userID)
+	}
+
+	return *lastTrade, nil
+}
+
+// GetReservedTotal returns how much of the currency is reserved by open orders across all users.
+func (pc *postgresClient) GetReservedTotal(ctx context.Context, currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	reserved := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COALESCE(SUM(reserved), 0)
+		 FROM users_money
+		 WHERE currency = $1`,
+		currency,
+	).Scan(&reserved)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get reserved total of the currency (%v); err: %v", currency, err)
+	}
+
+	return reserved, nil
+}
+
+// GetUserTrades returns trades of the user matching the filter, newest first.
+// Direction of every trade is relative to the user.
+func (pc *postgresClient) GetUserTrades(ctx context.Context, userID uint64, filter TradeFilter) ([]Trade, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if filter.Limit < 0 || filter.Offset < 0 {
+		return nil, fmt.Errorf("%w; limit and offset must not be negative", ErrInvalidArgument)
+	}
+
+	args := []interface{}{LedgerOperationTrade, userID}
+	conditions := []string{"operation = $1"}
+
+	switch filter.Direction {
+	case TradeDirectionSent:
+		conditions = append(conditions, "seller_id = $2")
+	case TradeDirectionReceived:
+		conditions = append(conditions, "buyer_id = $2")
+	default:
+		conditions = append(conditions, "(seller_id = $2 OR buyer_id = $2)")
+	}
+
+	if filter.Currency != "" {
+		args = append(args, normalizeCurrency(filter.Currency))
+		conditions = append(conditions, fmt.Sprintf("currency = $%d", len(args)))
+	}
+
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf(
+		`SELECT id, seller_id, buyer_id, currency, amount, created_at
+		 FROM ledger
+		 WHERE %s
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT NULLIF($%d, 0)
+		 OFFSET $%d`,
+		strings.Join(conditions, " AND "),
+		len(args)-1,
+		len(args),
+	)
+
+	rows, err := pc.connection.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get trades of the user (id = %v); err: %v", userID, err)
+	}
+
+	defer rows.Close()
+
+	trades := []Trade{}
+	for rows.Next() {
+		trade := Trade{}
+		err = rows.Scan(&trade.ID, &trade.SellerID, &trade.BuyerID, &trade.Currency, &trade.Amount, &trade.CreatedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan trade from the postgres database; err: %v", err)
+		}
+
+		trade.Direction = TradeDirectionReceived
+		if trade.SellerID == userID {
+			trade.Direction = TradeDirectionSent
+		}
+
+		trades = append(trades, trade)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get trades of the user (id = %v); err: %v", userID, rows.Err())
+	}
+
+	return trades, nil
+}
+
+// GetAuthRecord returns only what is needed to authenticate the user: the id and the password hash.
+// The caller verifies the password and records the outcome with RecordLogin.
+// Returns ErrUserNotFound if nobody uses the email.
+func (pc *postgresClient) GetAuthRecord(ctx context.Context, email string) (uint64, string, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, "", err
+	}
+
+	if err := requireNotBlank("email", email); err != nil {
+		return 0, "", err
+	}
+
+	id := uint64(0)
+	hash := ""
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT id, pass
+		 FROM users
+		 WHERE email = $1
+		 AND deleted_at IS NULL`,
+		email,
+	).Scan(&id, &hash)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, "", fmt.Errorf("%w; email %v", ErrUserNotFound, email)
+		}
+
+		return 0, "", fmt.Errorf("postgres cannot return user's data (email = %v); err: %v", email, err)
+	}
+
+	return id, hash, nil
+}
+
+// RehashPassword replaces the user's password hash with newHash if it is still oldHash.
+// The handler stores the hashes as they are passed, so detecting an outdated algorithm is up to the caller:
+// after the password was verified against the hash from GetAuthRecord, the caller hashes it with the new algorithm
+// and passes both hashes here; users are migrated one by one as they sign in.
+// Returns ErrPasswordChanged if the hash was changed since it was read (or the user was deleted),
+// so a newer password is never overwritten.
+func (pc *postgresClient) RehashPassword(ctx context.Context, userID uint64, oldHash, newHash string) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("hash", newHash); err != nil {
+		return err
+	}
+
+	tag, err := pc.connection.Exec(
+		ctx,
+		`UPDATE users
+		 SET pass = $3
+		 WHERE id = $1
+		 AND pass = $2
+		 AND deleted_at IS NULL`,
+		userID,
+		oldHash,
+		newHash,
+	)
+
+	if err != nil {
+		return fmt.Errorf("cannot update password hash of the user (id = %v); err: %v", userID, err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w; user id %v", ErrPasswordChanged, userID)
+	}
+
+	return nil
+}
+
+// GetCurrencyVolume returns the total amount of the currency ever traded, read from currency_stats instead of the ledger.
+func (pc *postgresClient) GetCurrencyVolume(ctx context.Context, currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	volume := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COALESCE(SUM(total_volume), 0)
+		 FROM currency_stats
+		 WHERE currency = $1`,
+		currency,
+	).Scan(&volume)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get volume of the currency (%v); err: %v", currency, err)
+	}
+
+	return volume, nil
+}
+
+// FindLargeHolders returns users holding more than threshold of the currency, the largest holders first
+func (pc *postgresClient) FindLargeHolders(ctx context.Context, currency string, threshold float64) ([]HolderAmount, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT user_id, amount
+		 FROM users_money
+		 WHERE currency = $1
+		 AND amount > $2
+		 ORDER BY amount DESC, user_id`,
+		currency,
+		threshold,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get large holders of the currency (%v); err: %v", currency, err)
+	}
+
+	defer rows.Close()
+
+	res := []HolderAmount{}
+	for rows.Next() {
+		holder := HolderAmount{}
+		err = rows.Scan(&holder.UserID, &holder.Amount)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan holder from the postgres database; err: %v", err)
+		}
+
+		res = append(res, holder)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get large holders of the currency (%v); err: %v", currency, rows.Err())
+	}
+
+	return res, nil
+}
+
+// GetCurrencyValueAt returns the value the currency had at the given moment according to currency_history.
+// Returns ErrNoHistoricalRate if nothing was recorded for the currency before that moment.
+func (pc *postgresClient) GetCurrencyValueAt(ctx context.Context, currency string, at time.Time) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	value := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT value
+		 FROM currency_history
+		 WHERE currency = $1
+		 AND changed_at <= $2
+		 ORDER BY changed_at DESC, id DESC
+		 LIMIT 1`,
+		currency,
+		at,
+	).Scan(&value)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("%w; currency %v at %v", ErrNoHistoricalRate, currency, at)
+		}
+
+		return 0, fmt.Errorf("cannot get value of the currency (%v) at %v; err: %v", currency, at, err)
+	}
+
+	return value, nil
+}
+
+// GetCurrencyDetail returns the value, supply, number of holders, trading state and the time of the last value change of the currency.
+// Returns ErrCurrencyNotFound if the currency does not exist.
+func (pc *postgresClient) GetCurrencyDetail(ctx context.Context, currency string) (*CurrencyDetail, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	detail := &CurrencyDetail{}
+	var updatedAt *time.Time
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT c.currency,
+			c.value,
+			c.trading_halted,
+			(SELECT COALESCE(SUM(amount), 0) FROM users_money WHERE currency = c.currency),
+			(SELECT COUNT(*) FROM users_money WHERE currency = c.currency AND amount > 0),
+			(SELECT MAX(changed_at) FROM currency_history WHERE currency = c.currency)
+		 FROM currencies c
+		 WHERE c.currency = $1`,
+		currency,
+	).Scan(&detail.Currency, &detail.Value, &detail.Halted, &detail.Supply, &detail.Holders, &updatedAt)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+		}
+
+		return nil, fmt.Errorf("cannot get details of the currency (%v); err: %v", currency, err)
+	}
+
+	if updatedAt != nil {
+		detail.UpdatedAt = *updatedAt
+	}
+
+	return detail, nil
+}
+
+// SendCurrencyIfRate works as SendCurrency but only if the value of the currency does not exceed maxRate.
+// The value is read and locked within the transfer transaction, so it cannot change before the transfer is committed.
+// Returns ErrRateExceeded if the value is above maxRate.
+func (pc *postgresClient) SendCurrencyIfRate(ctx context.Context, sellerID, buyerID uint64, currency string, value, maxRate float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireDifferentUsers(sellerID, buyerID); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	if err := pc.allow(sendRateLimitKey(sellerID)); err != nil {
+		return err
+	}
+
+	return retryOnTxConflict(ctx, func() error {
+		tx, err := pc.connection.BeginTx(ctx, pc.settings.SendCurrencyTxOptions)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction; err %w", err)
+		}
+
+		rate := float64(0)
+		err = tx.QueryRow(
+			ctx,
+			`SELECT value
+			 FROM currencies
+			 WHERE currency = $1
+			 FOR SHARE`,
+			currency,
+		).Scan(&rate)
+
+		if err != nil {
+			tx.Rollback(ctx)
+
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+			}
+
+			return fmt.Errorf("cannot get value of the currency (%v); err: %w", currency, err)
+		}
+
+		if rate > maxRate {
+			tx.Rollback(ctx)
+			return fmt.Errorf("%w; value of %v is %v, max %v", ErrRateExceeded, currency, rate, maxRate)
+		}
+
+		_, err = transfer(ctx, tx, LedgerOperationTrade, sellerID, buyerID, currency, value)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot commit transaction; err: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Barter atomically exchanges amountA of currencyA of userA for amountB of currencyB of userB.
+// Both trades are written to the ledger as one batch, so they can be reverted together by ReverseBatch.
+// Returns ErrInsufficientFunds if either side does not have enough.
+func (pc *postgresClient) Barter(ctx context.Context, userA, userB uint64, currencyA string, amountA float64, currencyB string, amountB float64) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currencyA", currencyA); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currencyB", currencyB); err != nil {
+		return err
+	}
+
+	if err := requireDifferentUsers(userA, userB); err != nil {
+		return err
+	}
+
+	currencyA = normalizeCurrency(currencyA)
+	currencyB = normalizeCurrency(currencyB)
+
+	if err := pc.allow(sendRateLimitKey(userA)); err != nil {
+		return err
+	}
+
+	type leg struct {
+		sellerID uint64
+		buyerID  uint64
+		currency string
+		amount   float64
+	}
+
+	legs := []leg{
+		{sellerID: userA, buyerID: userB, currency: currencyA, amount: amountA},
+		{sellerID: userB, buyerID: userA, currency: currencyB, amount: amountB},
+	}
+
+	// lock the balances in the same order whoever initiates the barter to avoid deadlocks
+	locking := []leg{legs[0], legs[1]}
+	if userB < userA {
+		locking[0], locking[1] = locking[1], locking[0]
+	}
+
+	return retryOnTxConflict(ctx, func() error {
+		tx, err := pc.connection.BeginTx(ctx, pc.settings.SendCurrencyTxOptions)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction; err %w", err)
+		}
+
+		for _, l := range locking {
+			amount := float64(0)
+			err = tx.QueryRow(
+				ctx,
+				`SELECT amount
+				 FROM users_money
+				 WHERE user_id = $1
+				 AND currency = $2
+				 FOR UPDATE`,
+				l.sellerID,
+				l.currency,
+			).Scan(&amount)
+
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				tx.Rollback(ctx)
+				return fmt.Errorf("cannot get user's (id = %v) amount of the currency (%v); err: %w", l.sellerID, l.currency, err)
+			}
+
+			if amount < l.amount {
+				tx.Rollback(ctx)
+				return fmt.Errorf("%w; user with id %v does not have %v %v", ErrInsufficientFunds, l.sellerID, l.amount, l.currency)
+			}
+		}
+
+		batchID := uint64(0)
+		for _, l := range legs {
+			tradeID, err := transfer(ctx, tx, LedgerOperationTrade, l.sellerID, l.buyerID, l.currency, l.amount)
+			if err != nil {
+				tx.Rollback(ctx)
+				return err
+			}
+
+			if batchID == 0 {
+				batchID = tradeID
+			}
+
+			_, err = tx.Exec(ctx, "UPDATE ledger SET batch_id = $1 WHERE id = $2", batchID, tradeID)
+			if err != nil {
+				tx.Rollback(ctx)
+				return fmt.Errorf("cannot add trade (id = %v) to the batch (id = %v); err: %w", tradeID, batchID, err)
+			}
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot commit transaction; err: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// GetTotalCirculation returns the sum of all the users' amounts regardless of the currency
+func (pc *postgresClient) GetTotalCirculation(ctx context.Context) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	total := float64(0)
+	err := pc.connection.QueryRow(ctx, "SELECT COALESCE(SUM(amount), 0) FROM users_money").Scan(&total)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get total circulation from the postgres database; err: %v", err)
+	}
+
+	return total, nil
+}
+
+// FindOrphanUserBalances returns ids of the users_money rows' users that do not exist in the users table.
+// The foreign key normally prevents such rows, so any result means the data was changed bypassing it.
+func (pc *postgresClient) FindOrphanUserBalances(ctx context.Context) ([]uint64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT DISTINCT um.user_id
+		 FROM users_money um
+		 WHERE NOT EXISTS (
+			SELECT 1
+			FROM users u
+			WHERE u.id = um.user_id
+		 )
+		 ORDER BY um.user_id`,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get orphan user balances; err: %v", err)
+	}
+
+	defer rows.Close()
+
+	userIDs := []uint64{}
+	for rows.Next() {
+		userID := uint64(0)
+		err = rows.Scan(&userID)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan orphan user balance; err: %v", err)
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get orphan user balances; err: %v", rows.Err())
+	}
+
+	return userIDs, nil
+}
+
+// GetUserTradeCount returns how many trades the user took part in as a seller or a buyer
+func (pc *postgresClient) GetUserTradeCount(ctx context.Context, userID uint64) (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COUNT(*)
+		 FROM ledger
+		 WHERE operation = $1
+		 AND (seller_id = $2 OR buyer_id = $2)`,
+		LedgerOperationTrade,
+		userID,
+	).Scan(&count)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get trade count of the user (id = %v); err: %v", userID, err)
+	}
+
+	return count, nil
+}
+
+// GetCurrencyHistory returns the values of the currency changed within [from, to), oldest first.
+// A positive bucket downsamples the result to the last value of every bucket-long window (aligned to the unix epoch);
+// windows without changes are omitted, the value of the previous point is still in effect there. 0 returns every change.
+func (pc *postgresClient) GetCurrencyHistory(ctx context.Context, currency string, from, to time.Time, bucket time.Duration) ([]CurrencyHistoryPoint, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	if bucket < 0 {
+		return nil, fmt.Errorf("%w; bucket must not be negative", ErrInvalidArgument)
+	}
+
+	currency = normalizeCurrency(currency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT value, changed_at
+		 FROM (
+			SELECT DISTINCT ON (
+				CASE WHEN $4::FLOAT > 0 THEN FLOOR(EXTRACT(EPOCH FROM changed_at) / $4::FLOAT) ELSE id END
+			) value, changed_at
+			FROM currency_history
+			WHERE currency = $1
+			AND changed_at >= $2
+			AND changed_at < $3
+			ORDER BY
+				CASE WHEN $4::FLOAT > 0 THEN FLOOR(EXTRACT(EPOCH FROM changed_at) / $4::FLOAT) ELSE id END,
+				changed_at DESC,
+				id DESC
+		 ) points
+		 ORDER BY changed_at`,
+		currency,
+		from,
+		to,
+		bucket.Seconds(),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get history of the currency (%v); err: %v", currency, err)
+	}
+
+	defer rows.Close()
+
+	points := []CurrencyHistoryPoint{}
+	for rows.Next() {
+		point := CurrencyHistoryPoint{}
+		err = rows.Scan(&point.Value, &point.ChangedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan currency history from the postgres database; err: %v", err)
+		}
+
+		points = append(points, point)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get history of the currency (%v); err: %v", currency, rows.Err())
+	}
+
+	return points, nil
+}
+
+// EmailExists reports whether the email is already registered, ignoring the case.
+// It reveals whether somebody uses the email, so expose it only behind rate limiting or to trusted callers.
+func (pc *postgresClient) EmailExists(ctx context.Context, email string) (bool, error) {
+	if err := pc.checkClosed(); err != nil {
+		return false, err
+	}
+
+	if err := requireNotBlank("email", email); err != nil {
+		return false, err
+	}
+
+	exists := false
+	err := pc.connection.QueryRow(
+		ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND deleted_at IS NULL)",
+		strings.TrimSpace(email),
+	).Scan(&exists)
+
+	if err != nil {
+		return false, fmt.Errorf("cannot check whether the email (%v) is registered; err: %v", email, err)
+	}
+
+	return exists, nil
+}
+
+// maxBalancesPageSize caps the limit of GetBalancesForCurrency
+const maxBalancesPageSize = 1000
+
+// GetBalancesForCurrency returns up to limit holders of the currency starting from the offset, the largest holders first.
+// Limit 0 or above maxBalancesPageSize is treated as maxBalancesPageSize.
+func (pc *postgresClient) GetBalancesForCurrency(ctx context.Context, currency string, limit, offset int) ([]HolderAmount, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	if limit < 0 || offset < 0 {
+		return nil, fmt.Errorf("%w; limit and offset must not be negative", ErrInvalidArgument)
+	}
+
+	if limit == 0 || limit > maxBalancesPageSize {
+		limit = maxBalancesPageSize
+	}
+
+	currency = normalizeCurrency(currency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT user_id, amount
+		 FROM users_money
+		 WHERE currency = $1
+		 AND amount > 0
+		 ORDER BY amount DESC, user_id
+		 LIMIT $2
+		 OFFSET $3`,
+		currency,
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get balances of the currency (%v); err: %v", currency, err)
+	}
+
+	defer rows.Close()
+
+	res := []HolderAmount{}
+	for rows.Next() {
+		holder := HolderAmount{}
+		err = rows.Scan(&holder.UserID, &holder.Amount)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan holder from the postgres database; err: %v", err)
+		}
+
+		res = append(res, holder)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get balances of the currency (%v); err: %v", currency, rows.Err())
+	}
+
+	return res, nil
+}
+
+// ZeroUserBalances sets all the user's amounts to 0 and returns how many balances were changed.
+// Every zeroed balance is written to the ledger as a wipe with the previous amount.
+func (pc *postgresClient) ZeroUserBalances(ctx context.Context, userID uint64) (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	tag, err := pc.connection.Exec(
+		ctx,
+		`WITH wiped AS (
+			UPDATE users_money um
+			SET amount = 0
+			FROM users_money old
+			WHERE old.id = um.id
+			AND um.user_id = $2
+			AND um.amount <> 0
+			RETURNING um.user_id, um.currency, old.amount
+		 )
+		 INSERT INTO ledger (operation, seller_id, currency, amount, previous_amount)
+		 SELECT $1, user_id, currency, amount, amount
+		 FROM wiped`,
+		LedgerOperationWipe,
+		userID,
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot zero balances of the user (id = %v); err: %v", userID, err)
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+// GetRateSpread returns the lowest and the highest currency values and the currencies that have them
+// (ties are resolved alphabetically). With a single currency it is both the min and the max.
+// Returns ErrCurrencyNotFound if there are no currencies.
+func (pc *postgresClient) GetRateSpread(ctx context.Context) (min, max float64, minCurrency, maxCurrency string, err error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, 0, "", "", err
+	}
+
+	err = pc.connection.QueryRow(
+		ctx,
+		`SELECT lowest.value, highest.value, lowest.currency, highest.currency
+		 FROM (
+			SELECT currency, value
+			FROM currencies
+			ORDER BY value, currency
+			LIMIT 1
+		 ) lowest
+		 CROSS JOIN (
+			SELECT currency, value
+			FROM currencies
+			ORDER BY value DESC, currency
+			LIMIT 1
+		 ) highest`,
+	).Scan(&min, &max, &minCurrency, &maxCurrency)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, 0, "", "", fmt.Errorf("%w; there are no currencies", ErrCurrencyNotFound)
+		}
+
+		return 0, 0, "", "", fmt.Errorf("cannot get rate spread from the postgres database; err: %v", err)
+	}
+
+	return min, max, minCurrency, maxCurrency, nil
+}
+
+// maxVolumeBuckets caps the number of points GetVolumeTimeSeries may return
+const maxVolumeBuckets = 10000
+
+// GetVolumeTimeSeries returns the traded amount of the currency per bucket-long interval within [from, to), oldest first.
+// Buckets start at from; buckets without trades have zero volume, so there are no gaps.
+func (pc *postgresClient) GetVolumeTimeSeries(ctx context.Context, currency string, from, to time.Time, bucket time.Duration) ([]VolumePoint, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return nil, err
+	}
+
+	if bucket <= 0 || !to.After(from) {
+		return nil, fmt.Errorf("%w; bucket must be positive and to must be after from", ErrInvalidArgument)
+	}
+
+	buckets := to.Sub(from) / bucket
+	if to.Sub(from)%bucket != 0 {
+		buckets++
+	}
+	if buckets > maxVolumeBuckets {
+		return nil, fmt.Errorf("%w; %v buckets requested, at most %v allowed", ErrInvalidArgument, int64(buckets), maxVolumeBuckets)
+	}
+
+	currency = normalizeCurrency(currency)
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT b.start, COALESCE(SUM(l.amount), 0)
+		 FROM (
+			SELECT $3::TIMESTAMP + n * MAKE_INTERVAL(secs => $5::FLOAT) AS start
+			FROM GENERATE_SERIES(0, $6::INT - 1) n
+		 ) b
+		 LEFT JOIN ledger l
+			ON l.operation = $1
+			AND l.currency = $2
+			AND l.created_at >= b.start
+			AND l.created_at < LEAST(b.start + MAKE_INTERVAL(secs => $5::FLOAT), $4::TIMESTAMP)
+		 GROUP BY b.start
+		 ORDER BY b.start`,
+		LedgerOperationTrade,
+		currency,
+		from,
+		to,
+		bucket.Seconds(),
+		int(buckets),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get volume time series of the currency (%v); err: %v", currency, err)
+	}
+
+	defer rows.Close()
+
+	points := []VolumePoint{}
+	for rows.Next() {
+		point := VolumePoint{}
+		err = rows.Scan(&point.Start, &point.Volume)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan volume point from the postgres database; err: %v", err)
+		}
+
+		points = append(points, point)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get volume time series of the currency (%v); err: %v", currency, rows.Err())
+	}
+
+	return points, nil
+}
+
+// CountCurrenciesAboveValue returns how many currencies are worth at least minValue
+func (pc *postgresClient) CountCurrenciesAboveValue(ctx context.Context, minValue float64) (int, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err := pc.connection.QueryRow(ctx, "SELECT COUNT(*) FROM currencies WHERE value >= $1", minValue).Scan(&count)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot count currencies worth at least %v; err: %v", minValue, err)
+	}
+
+	return count, nil
+}
+
+// GetUserActivity returns up to limit latest ledger entries that changed the balances of the user
+// (trades, fees, refunds, credits, recalls, wipes, adjustments and bonuses), newest first; limit 0 means no limit
+func (pc *postgresClient) GetUserActivity(ctx context.Context, userID uint64, limit int) ([]ActivityEntry, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if limit < 0 {
+		return nil, fmt.Errorf("%w; limit must not be negative", ErrInvalidArgument)
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT id,
+			operation,
+			currency,
+			CASE WHEN seller_id = $1 THEN -amount ELSE amount END,
+			created_at
+		 FROM ledger
+		 WHERE (seller_id = $1 OR buyer_id = $1)
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT NULLIF($2, 0)`,
+		userID,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get activity of the user (id = %v); err: %v", userID, err)
+	}
+
+	defer rows.Close()
+
+	entries := []ActivityEntry{}
+	for rows.Next() {
+		entry := ActivityEntry{}
+		err = rows.Scan(&entry.ID, &entry.Operation, &entry.Currency, &entry.Amount, &entry.CreatedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan activity entry from the postgres database; err: %v", err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get activity of the user (id = %v); err: %v", userID, rows.Err())
+	}
+
+	return entries, nil
+}
+
+// GetAverageHolding returns the average amount of the currency per holder; 0 if nobody holds it
+func (pc *postgresClient) GetAverageHolding(ctx context.Context, currency string) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	average := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COALESCE(SUM(amount) / NULLIF(COUNT(DISTINCT user_id), 0), 0)
+		 FROM users_money
+		 WHERE currency = $1
+		 AND amount > 0`,
+		currency,
+	).Scan(&average)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get average holding of the currency (%v); err: %v", currency, err)
+	}
+
+	return average, nil
+}
+
+// GetInactiveUsers returns up to limit users whose latest trade was before since or who never traded,
+// the ones inactive for the longest time first (those who never traded go first); limit 0 means no limit.
+// Merged and treasury users are omitted.
+func (pc *postgresClient) GetInactiveUsers(ctx context.Context, since time.Time, limit int) ([]User, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if limit < 0 {
+		return nil, fmt.Errorf("%w; limit must not be negative", ErrInvalidArgument)
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		`SELECT u.id, u.email
+		 FROM users u
+		 LEFT JOIN (
+			SELECT user_id, MAX(created_at) AS last_trade
+			FROM (
+				SELECT seller_id AS user_id, created_at FROM ledger WHERE operation = $1
+				UNION ALL
+				SELECT buyer_id AS user_id, created_at FROM ledger WHERE operation = $1
+			) trades
+			GROUP BY user_id
+		 ) activity ON activity.user_id = u.id
+		 WHERE u.deleted_at IS NULL
+		 AND NOT u.treasury
+		 AND (activity.last_trade IS NULL OR activity.last_trade < $2)
+		 ORDER BY activity.last_trade NULLS FIRST, u.id
+		 LIMIT NULLIF($3, 0)`,
+		LedgerOperationTrade,
+		since,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot get users inactive since %v; err: %v", since, err)
+	}
+
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user := User{}
+		err = rows.Scan(&user.ID, &user.Email)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan user from the postgres database; err: %v", err)
+		}
+
+		users = append(users, user)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("cannot get users inactive since %v; err: %v", since, rows.Err())
+	}
+
+	return users, nil
+}
+
+// UpdateCurrencyBy works as UpdateCurrency but also records the admin who changed the value and why in currency_history.
+// Returns ErrCurrencyNotFound if the currency does not exist.
+func (pc *postgresClient) UpdateCurrencyBy(ctx context.Context, adminID uint64, currency string, newValue float64, reason string) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return err
+	}
+
+	if err := requireNotBlank("reason", reason); err != nil {
+		return err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	tag, err := pc.connection.Exec(
+		ctx,
+		`WITH updated AS (
+			UPDATE currencies
+			SET value = $1, version = version + 1
+			WHERE currency = $2
+			RETURNING currency, value
+		 )
+		 INSERT INTO currency_history (currency, value, admin_id, reason)
+		 SELECT currency, value, $3, $4
+		 FROM updated`,
+		newValue,
+		currency,
+		adminID,
+		reason,
+	)
+
+	if err != nil {
+		return fmt.Errorf("postgres can not update currency %v to the new value %v; err: %v", currency, newValue, err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w; currency %v", ErrCurrencyNotFound, currency)
+	}
+
+	pc.currencies.invalidate(pc.tenant(ctx))
+
+	return nil
+}
+
+// GetConcentration returns the fraction (0..1) of the currency supply held by the topN largest holders;
+// if there are fewer holders all of them are counted. Returns 0 if nobody holds the currency.
+func (pc *postgresClient) GetConcentration(ctx context.Context, currency string, topN int) (float64, error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, err
+	}
+
+	if topN <= 0 {
+		return 0, fmt.Errorf("%w; topN must be positive", ErrInvalidArgument)
+	}
+
+	currency = normalizeCurrency(currency)
+
+	concentration := float64(0)
+	err := pc.connection.QueryRow(
+		ctx,
+		`SELECT COALESCE(
+			(
+				SELECT SUM(amount)
+				FROM (
+					SELECT amount
+					FROM users_money
+					WHERE currency = $1
+					AND amount > 0
+					ORDER BY amount DESC
+					LIMIT $2
+				) top
+			) / NULLIF((
+				SELECT SUM(amount)
+				FROM users_money
+				WHERE currency = $1
+				AND amount > 0
+			), 0),
+			0
+		 )`,
+		currency,
+		topN,
+	).Scan(&concentration)
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot get concentration of the currency (%v); err: %v", currency, err)
+	}
+
+	return concentration, nil
+}
+
+// RecomputeBalance returns the stored balance of the user and the balance derived from the ledger
+// (everything the user received minus everything the user sent) without changing anything.
+// Changes that are not written to the ledger (the initial money of the new users, UpdateCurrencyAmount
+// and merging currency codes by NormalizeCurrencyCodes) make the values differ legitimately,
+// as do the entries deleted by PruneLedger: every user with pruned history reports a difference.
+func (pc *postgresClient) RecomputeBalance(ctx context.Context, userID uint64, currency string) (stored, computed float64, err error) {
+	if err := pc.checkClosed(); err != nil {
+		return 0, 0, err
+	}
+
+	if err := requireNotBlank("currency", currency); err != nil {
+		return 0, 0, err
+	}
+
+	currency = normalizeCurrency(currency)
+
+	err = pc.connection.QueryRow(
+		ctx,
+		`SELECT
+			(
+				SELECT COALESCE(SUM(amount), 0)
+				FROM users_money
+				WHERE user_id = $1
+				AND currency = $2
+			),
+			(
+				SELECT COALESCE(SUM(CASE WHEN buyer_id = $1 THEN amount ELSE 0 END), 0)
+					- COALESCE(SUM(CASE WHEN seller_id = $1 THEN amount ELSE 0 END), 0)
+				FROM ledger
+				WHERE currency = $2
+				AND (seller_id = $1 OR buyer_id = $1)
+			)`,
+		userID,
+		currency,
+	).Scan(&stored, &computed)
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot recompute user's (id = %v) balance of the currency (%v); err: %v", userID, currency, err)
+	}
+
+	return stored, computed, nil
 }
@@ -0,0 +1,26 @@
+package postgres
+
+import "fmt"
+
+// RateLimiter decides whether a write of the key may go to the database now.
+// Keys are "send:<sellerID>" for the currency transfers and "register:<email>" for the new users.
+type RateLimiter interface {
+	Allow(key string) bool
+}
+
+// allow returns ErrRateLimited if the configured RateLimiter denies the key; without a limiter everything is allowed
+func (pc *postgresClient) allow(key string) error {
+	if pc.settings.RateLimiter == nil || pc.settings.RateLimiter.Allow(key) {
+		return nil
+	}
+
+	return fmt.Errorf("%w; key %v", ErrRateLimited, key)
+}
+
+func sendRateLimitKey(sellerID uint64) string {
+	return fmt.Sprintf("send:%v", sellerID)
+}
+
+func registerRateLimitKey(email string) string {
+	return "register:" + email
+}
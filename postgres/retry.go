@@ -0,0 +1,68 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+const (
+	serializationFailureCode = "40001"
+	deadlockDetectedCode     = "40P01"
+)
+
+// maxTxAttempts is how many times a transaction is executed before its conflict is returned
+const maxTxAttempts = 5
+
+// txRetryBackoff is the base of the exponential backoff between the attempts
+const txRetryBackoff = 10 * time.Millisecond
+
+// retryOnTxConflict runs fn until it does not fail with a serialization failure (SQLSTATE 40001)
+// or a deadlock (SQLSTATE 40P01), at most maxTxAttempts times, sleeping a jittered backoff between the attempts.
+// Returns ErrDeadlockRetriesExceeded if the last attempt is a deadlock as well.
+// fn must run the whole transaction, from begin to commit.
+func retryOnTxConflict(ctx context.Context, fn func() error) error {
+	err := error(nil)
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		err = fn()
+		if !isSerializationFailure(err) && !isDeadlock(err) {
+			return err
+		}
+
+		if attempt == maxTxAttempts-1 {
+			break
+		}
+
+		backoff := txRetryBackoff << attempt
+		backoff += time.Duration(rand.Int63n(int64(backoff)))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+
+	if isDeadlock(err) {
+		return fmt.Errorf("%w; %v attempts failed, last error: %v", ErrDeadlockRetriesExceeded, maxTxAttempts, err)
+	}
+
+	return err
+}
+
+func isSerializationFailure(err error) bool {
+	return hasPgErrorCode(err, serializationFailureCode)
+}
+
+func isDeadlock(err error) bool {
+	return hasPgErrorCode(err, deadlockDetectedCode)
+}
+
+func hasPgErrorCode(err error, code string) bool {
+	pgErr := &pgconn.PgError{}
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestRetryOnTxConflict(t *testing.T) {
+	deadlock := fmt.Errorf("cannot update currency amount; err: %w", &pgconn.PgError{Code: deadlockDetectedCode})
+	serializationFailure := &pgconn.PgError{Code: serializationFailureCode}
+	other := errors.New("other")
+
+	tests := []struct {
+		name         string
+		errs         []error // error of every attempt; the last one repeats
+		wantAttempts int
+		check        func(err error) bool
+	}{
+		{
+			name:         "success",
+			errs:         []error{nil},
+			wantAttempts: 1,
+			check:        func(err error) bool { return err == nil },
+		},
+		{
+			name:         "other errors are not retried",
+			errs:         []error{other},
+			wantAttempts: 1,
+			check:        func(err error) bool { return err == other },
+		},
+		{
+			name:         "deadlock is retried until success",
+			errs:         []error{deadlock, deadlock, nil},
+			wantAttempts: 3,
+			check:        func(err error) bool { return err == nil },
+		},
+		{
+			name:         "persistent deadlock",
+			errs:         []error{deadlock},
+			wantAttempts: maxTxAttempts,
+			check: func(err error) bool {
+				return errors.Is(err, ErrDeadlockRetriesExceeded)
+			},
+		},
+		{
+			name:         "persistent serialization failure",
+			errs:         []error{serializationFailure},
+			wantAttempts: maxTxAttempts,
+			check: func(err error) bool {
+				return isSerializationFailure(err) && !errors.Is(err, ErrDeadlockRetriesExceeded)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := retryOnTxConflict(context.Background(), func() error {
+				err := tt.errs[len(tt.errs)-1]
+				if attempts < len(tt.errs) {
+					err = tt.errs[attempts]
+				}
+
+				attempts++
+				return err
+			})
+
+			if attempts != tt.wantAttempts {
+				t.Errorf("got %v attempts, want %v", attempts, tt.wantAttempts)
+			}
+
+			if !tt.check(err) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestRetryOnTxConflictStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts := 0
+	err := retryOnTxConflict(ctx, func() error {
+		attempts++
+		return &pgconn.PgError{Code: deadlockDetectedCode}
+	})
+
+	if attempts != 1 || !isDeadlock(err) {
+		t.Fatalf("got %v attempts and %v, want 1 attempt and the deadlock", attempts, err)
+	}
+}
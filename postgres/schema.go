@@ -0,0 +1,5 @@
+package postgres
+
+// SchemaVersion is the number of the latest migration this package expects to be applied.
+// Every new migration has to insert its number into schema_migrations and bump this constant.
+const SchemaVersion = 23
@@ -0,0 +1,69 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+func TestConnectContextUsesSchema(t *testing.T) {
+	ctx := context.Background()
+	config := newTestDatabase(t)
+
+	conn, err := pgx.ConnectConfig(ctx, config.ConnConfig)
+	if err != nil {
+		t.Fatalf("cannot connect to the test database: %v", err)
+	}
+
+	_, err = conn.Exec(ctx, "CREATE SCHEMA exchange")
+	conn.Close(ctx)
+	if err != nil {
+		t.Fatalf("cannot create schema: %v", err)
+	}
+
+	config.ConnConfig.RuntimeParams["search_path"] = "exchange"
+	migrate(t, config)
+
+	settings := PostgreSettings{
+		User:     config.ConnConfig.User,
+		Password: config.ConnConfig.Password,
+		Host:     fmt.Sprintf("%s:%d", config.ConnConfig.Host, config.ConnConfig.Port),
+		DbName:   config.ConnConfig.Database,
+	}
+
+	// the tables live in the exchange schema only, so the default search_path does not find them
+	handler, err := ConnectContext(ctx, settings)
+	if err != nil {
+		t.Fatalf("ConnectContext without Schema: %v", err)
+	}
+
+	_, err = handler.GetCurrencyValue("USD")
+	handler.Close()
+	if err == nil {
+		t.Fatalf("GetCurrencyValue found the currencies without Schema")
+	}
+
+	settings.Schema = "exchange"
+	handler, err = ConnectContext(ctx, settings)
+	if err != nil {
+		t.Fatalf("ConnectContext with Schema: %v", err)
+	}
+
+	defer handler.Close()
+
+	err = handler.CheckSchemaVersion(ctx, SchemaVersion)
+	if err != nil {
+		t.Fatalf("CheckSchemaVersion: %v", err)
+	}
+
+	value, err := handler.GetCurrencyValue("USD")
+	if err != nil {
+		t.Fatalf("GetCurrencyValue: %v", err)
+	}
+
+	if value != 1 {
+		t.Fatalf("GetCurrencyValue(USD) = %v, want 1", value)
+	}
+}
@@ -0,0 +1,149 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// querier is the part of the pgxpool.Pool the handler uses to talk to the database
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+// tenantRouter sends every query to the pool of the tenant resolved from the context.
+// Tenant name is used as the database name; requests without a tenant fail with ErrTenantRequired
+// instead of silently going to the default database.
+// Pools are created lazily and every one of them may open up to config.MaxConns connections,
+// so the total number of connections grows with the number of tenants.
+type tenantRouter struct {
+	resolver       func(ctx context.Context) string
+	config         *pgxpool.Config
+	defaultPool    *pgxpool.Pool // pool of DbName; it only checks the settings at connect time
+	acquireTimeout time.Duration
+
+	mu    sync.Mutex
+	pools map[string]*pgxpool.Pool
+}
+
+func newTenantRouter(resolver func(ctx context.Context) string, config *pgxpool.Config, defaultPool *pgxpool.Pool, acquireTimeout time.Duration) *tenantRouter {
+	return &tenantRouter{
+		resolver:       resolver,
+		config:         config,
+		defaultPool:    defaultPool,
+		acquireTimeout: acquireTimeout,
+		pools:          make(map[string]*pgxpool.Pool),
+	}
+}
+
+func (tr *tenantRouter) pool(ctx context.Context) (querier, error) {
+	pool, err := tr.tenantPool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return withAcquireTimeout(pool, tr.acquireTimeout), nil
+}
+
+func (tr *tenantRouter) tenantPool(ctx context.Context) (*pgxpool.Pool, error) {
+	tenant := tr.resolver(ctx)
+	if tenant == "" {
+		return nil, ErrTenantRequired
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if pool, ok := tr.pools[tenant]; ok {
+		return pool, nil
+	}
+
+	config := tr.config.Copy()
+	config.ConnConfig.Database = tenant
+	config.LazyConnect = true
+
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the database of the tenant %v; err: %v", tenant, err)
+	}
+
+	tr.pools[tenant] = pool
+
+	return pool, nil
+}
+
+// Close closes the default pool and the pools of all the tenants
+func (tr *tenantRouter) Close() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	for tenant, pool := range tr.pools {
+		pool.Close()
+		delete(tr.pools, tenant)
+	}
+
+	tr.defaultPool.Close()
+}
+
+func (tr *tenantRouter) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	pool, err := tr.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.Exec(ctx, sql, args...)
+}
+
+func (tr *tenantRouter) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	pool, err := tr.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.Query(ctx, sql, args...)
+}
+
+func (tr *tenantRouter) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	pool, err := tr.pool(ctx)
+	if err != nil {
+		return errRow{err}
+	}
+
+	return pool.QueryRow(ctx, sql, args...)
+}
+
+func (tr *tenantRouter) Begin(ctx context.Context) (pgx.Tx, error) {
+	pool, err := tr.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.Begin(ctx)
+}
+
+func (tr *tenantRouter) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	pool, err := tr.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.BeginTx(ctx, txOptions)
+}
+
+// errRow is a pgx.Row that fails to scan with err
+type errRow struct {
+	err error
+}
+
+func (er errRow) Scan(dest ...interface{}) error {
+	return er.err
+}
@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type tenantKey struct{}
+
+func TestTenantRouting(t *testing.T) {
+	configA := newTestDatabase(t)
+	migrate(t, configA)
+	configB := newTestDatabase(t)
+	migrate(t, configB)
+
+	tenantA := configA.ConnConfig.Database
+	tenantB := configB.ConnConfig.Database
+
+	handler, err := connectWithSettings(context.Background(), configA, PostgreSettings{
+		TenantResolver: func(ctx context.Context) string {
+			tenant, _ := ctx.Value(tenantKey{}).(string)
+			return tenant
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	defer handler.Close()
+
+	ctxA := context.WithValue(context.Background(), tenantKey{}, tenantA)
+	ctxB := context.WithValue(context.Background(), tenantKey{}, tenantB)
+
+	value := 3.0
+	err = handler.CreateCurrency(ctxA, "TNT", &value)
+	if err != nil {
+		t.Fatalf("CreateCurrency of tenant a: %v", err)
+	}
+
+	detail, err := handler.GetCurrencyDetail(ctxA, "TNT")
+	if err != nil || detail.Value != value {
+		t.Fatalf("tenant a: got %v, %v; want the created currency", detail, err)
+	}
+
+	_, err = handler.GetCurrencyDetail(ctxB, "TNT")
+	if !errors.Is(err, ErrCurrencyNotFound) {
+		t.Fatalf("tenant b: got %v, want ErrCurrencyNotFound", err)
+	}
+
+	// most methods wrap the database errors with %v, so only the message of ErrTenantRequired is kept
+	_, err = handler.GetCurrenciesNum(context.Background())
+	if err == nil || !strings.Contains(err.Error(), ErrTenantRequired.Error()) {
+		t.Fatalf("request without a tenant: got %v, want ErrTenantRequired", err)
+	}
+
+	_, err = handler.GetCurrencies()
+	if err == nil || !strings.Contains(err.Error(), ErrTenantRequired.Error()) {
+		t.Fatalf("GetCurrencies without a context: got %v, want ErrTenantRequired", err)
+	}
+}
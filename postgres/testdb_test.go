@@ -0,0 +1,158 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testDSNEnv names the variable with the connection string of a postgres server the tests may create databases on;
+// the tests that need a database are skipped without it
+const testDSNEnv = "POSTGRES_TEST_DSN"
+
+func testDSN(t testing.TB) string {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%v is not set", testDSNEnv)
+	}
+
+	return dsn
+}
+
+// newTestDatabase creates an empty database dropped at the end of the test and returns its pool config
+func newTestDatabase(t testing.TB) *pgxpool.Config {
+	t.Helper()
+
+	ctx := context.Background()
+	dsn := testDSN(t)
+
+	admin, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatalf("cannot connect to the test server: %v", err)
+	}
+
+	name := fmt.Sprintf("exchange_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec(ctx, "CREATE DATABASE "+name)
+	if err != nil {
+		admin.Close(ctx)
+		t.Fatalf("cannot create database %v: %v", name, err)
+	}
+
+	t.Cleanup(func() {
+		admin.Exec(ctx, "DROP DATABASE "+name+" WITH (FORCE)")
+		admin.Close(ctx)
+	})
+
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("cannot parse %v: %v", testDSNEnv, err)
+	}
+
+	config.ConnConfig.Database = name
+
+	return config
+}
+
+// migrate applies migrations/*.sql in order (except the one creating the database) using the config
+func migrate(t testing.TB, config *pgxpool.Config) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	files, err := filepath.Glob(filepath.Join("..", "migrations", "*.sql"))
+	if err != nil {
+		t.Fatalf("cannot list migrations: %v", err)
+	}
+
+	version := func(file string) int {
+		v, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".sql"))
+		return v
+	}
+
+	sort.Slice(files, func(i, j int) bool { return version(files[i]) < version(files[j]) })
+
+	conn, err := pgx.ConnectConfig(ctx, config.ConnConfig)
+	if err != nil {
+		t.Fatalf("cannot connect to the test database: %v", err)
+	}
+
+	defer conn.Close(ctx)
+
+	for _, file := range files {
+		if version(file) == 1 {
+			continue
+		}
+
+		sql, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("cannot read migration %v: %v", file, err)
+		}
+
+		_, err = conn.Exec(ctx, string(sql))
+		if err != nil {
+			t.Fatalf("cannot apply migration %v: %v", file, err)
+		}
+	}
+}
+
+// newTestClient returns a handler connected to a new migrated database
+func newTestClient(t testing.TB, settings PostgreSettings) *postgresClient {
+	t.Helper()
+
+	config := newTestDatabase(t)
+	migrate(t, config)
+
+	handler, err := connectWithSettings(context.Background(), config, settings)
+	if err != nil {
+		t.Fatalf("cannot connect to the test database: %v", err)
+	}
+
+	t.Cleanup(handler.Close)
+
+	return handler.(*postgresClient)
+}
+
+// newTestUser registers a user with a unique email; every new user starts with 1000 USD
+func newTestUser(t testing.TB, pc *postgresClient) uint64 {
+	t.Helper()
+
+	email := fmt.Sprintf("user_%d@example.com", time.Now().UnixNano())
+	userID, err := pc.RegisterUser(context.Background(), email, "hash")
+	if err != nil {
+		t.Fatalf("cannot register user: %v", err)
+	}
+
+	return userID
+}
+
+// mustExec runs the statement on the test database failing the test on error
+func mustExec(t testing.TB, pc *postgresClient, sql string, args ...interface{}) {
+	t.Helper()
+
+	_, err := pc.connection.Exec(context.Background(), sql, args...)
+	if err != nil {
+		t.Fatalf("cannot execute %q: %v", sql, err)
+	}
+}
+
+func balance(t testing.TB, pc *postgresClient, userID uint64, currency string) float64 {
+	t.Helper()
+
+	amount, err := pc.GetUserCurrencyAmount(context.Background(), userID, currency, 0)
+	if err != nil {
+		t.Fatalf("cannot get balance of user %v: %v", userID, err)
+	}
+
+	return amount
+}
@@ -0,0 +1,319 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestSendCurrencyWithFee(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{FeePercent: 10})
+	ctx := context.Background()
+
+	seller := newTestUser(t, pc)
+	buyer := newTestUser(t, pc)
+	feeAccount := newTestUser(t, pc)
+	pc.settings.FeeAccountID = feeAccount
+
+	err := pc.SendCurrencyWithFee(ctx, seller, buyer, "USD", 100)
+	if err != nil {
+		t.Fatalf("SendCurrencyWithFee: %v", err)
+	}
+
+	sellerAmount := balance(t, pc, seller, "USD")
+	buyerAmount := balance(t, pc, buyer, "USD")
+	feeAmount := balance(t, pc, feeAccount, "USD")
+
+	if sellerAmount != 900 || buyerAmount != 1090 || feeAmount != 1010 {
+		t.Fatalf("seller %v, buyer %v, fee account %v; want 900, 1090, 1010", sellerAmount, buyerAmount, feeAmount)
+	}
+
+	if total := sellerAmount + buyerAmount + feeAmount; total != 3000 {
+		t.Fatalf("balances sum up to %v, want 3000", total)
+	}
+}
+
+func TestConcurrentSendsDoNotLoseDebits(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+
+	seller := newTestUser(t, pc)
+	buyer := newTestUser(t, pc)
+
+	const sends = 20
+	errs := make(chan error, sends)
+
+	var wg sync.WaitGroup
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- pc.SendCurrency(seller, buyer, "USD", 100)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrInsufficientFunds):
+			t.Fatalf("SendCurrency: %v", err)
+		}
+	}
+
+	if succeeded != 10 {
+		t.Fatalf("%v sends of 100 out of 1000 succeeded, want 10", succeeded)
+	}
+
+	sellerAmount := balance(t, pc, seller, "USD")
+	buyerAmount := balance(t, pc, buyer, "USD")
+	if sellerAmount != 0 || buyerAmount != 2000 {
+		t.Fatalf("seller %v, buyer %v; want 0, 2000", sellerAmount, buyerAmount)
+	}
+}
+
+func TestSendCurrencyByEmailIgnoresCase(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	seller := newTestUser(t, pc)
+	buyer, err := pc.RegisterUser(ctx, "Alice@example.com", "hash")
+	if err != nil {
+		t.Fatalf("RegisterUser: %v", err)
+	}
+
+	exists, err := pc.EmailExists(ctx, "alice@EXAMPLE.com")
+	if err != nil || !exists {
+		t.Fatalf("EmailExists: got %v, %v; want true", exists, err)
+	}
+
+	err = pc.SendCurrencyByEmail(ctx, seller, "alice@EXAMPLE.com", "USD", 10)
+	if err != nil {
+		t.Fatalf("SendCurrencyByEmail: %v", err)
+	}
+
+	if amount := balance(t, pc, buyer, "USD"); amount != 1010 {
+		t.Fatalf("buyer has %v USD, want 1010", amount)
+	}
+}
+
+func TestCrossTransfersSurviveDeadlocks(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+
+	userA := newTestUser(t, pc)
+	userB := newTestUser(t, pc)
+
+	// A->B locks A then B, B->A locks B then A, so concurrent pairs deadlock and must be retried
+	const pairs = 20
+	errs := make(chan error, 2*pairs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < pairs; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- pc.SendCurrency(userA, userB, "USD", 1)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- pc.SendCurrency(userB, userA, "USD", 1)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil && !errors.Is(err, ErrDeadlockRetriesExceeded) {
+			t.Fatalf("SendCurrency: %v", err)
+		}
+	}
+
+	if total := balance(t, pc, userA, "USD") + balance(t, pc, userB, "USD"); total != 2000 {
+		t.Fatalf("users hold %v USD together, want 2000", total)
+	}
+}
+
+func TestSendCurrencyKeepsMinimumBalance(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	mustExec(t, pc, "UPDATE currencies SET min_balance = 100 WHERE currency = 'USD'")
+
+	tests := []struct {
+		name    string
+		value   float64
+		wantErr error
+	}{
+		{"leaves more than the minimum", 899, nil},
+		{"leaves exactly the minimum", 900, nil},
+		{"leaves less than the minimum", 900.5, ErrBelowMinimumBalance},
+		{"whole balance", 1000, ErrBelowMinimumBalance},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seller := newTestUser(t, pc)
+			buyer := newTestUser(t, pc)
+
+			err := pc.SendCurrency(seller, buyer, "USD", tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SendCurrency(%v): got %v, want %v", tt.value, err, tt.wantErr)
+			}
+
+			want := float64(1000)
+			if tt.wantErr == nil {
+				want -= tt.value
+			}
+
+			if got := balance(t, pc, seller, "USD"); got != want {
+				t.Fatalf("seller has %v USD, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHaltedCurrencyAllowsRefundsOnly(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	seller := newTestUser(t, pc)
+	buyer := newTestUser(t, pc)
+
+	err := pc.SendCurrency(seller, buyer, "USD", 100)
+	if err != nil {
+		t.Fatalf("SendCurrency: %v", err)
+	}
+
+	tradeID := uint64(0)
+	err = pc.connection.QueryRow(
+		ctx,
+		"SELECT id FROM ledger WHERE operation = $1 AND seller_id = $2",
+		LedgerOperationTrade,
+		seller,
+	).Scan(&tradeID)
+	if err != nil {
+		t.Fatalf("cannot get the trade: %v", err)
+	}
+
+	err = pc.SetCurrencyHalted(ctx, "usd", true)
+	if err != nil {
+		t.Fatalf("SetCurrencyHalted: %v", err)
+	}
+
+	err = pc.SendCurrency(seller, buyer, "USD", 1)
+	if !errors.Is(err, ErrTradingHalted) {
+		t.Fatalf("SendCurrency of a halted currency: got %v, want %v", err, ErrTradingHalted)
+	}
+
+	err = pc.RefundTrade(ctx, tradeID)
+	if err != nil {
+		t.Fatalf("RefundTrade of a halted currency: %v", err)
+	}
+
+	if sellerAmount, buyerAmount := balance(t, pc, seller, "USD"), balance(t, pc, buyer, "USD"); sellerAmount != 1000 || buyerAmount != 1000 {
+		t.Fatalf("seller %v, buyer %v after the refund; want 1000, 1000", sellerAmount, buyerAmount)
+	}
+
+	err = pc.SetCurrencyHalted(ctx, "USD", false)
+	if err != nil {
+		t.Fatalf("SetCurrencyHalted: %v", err)
+	}
+
+	err = pc.SendCurrency(seller, buyer, "USD", 1)
+	if err != nil {
+		t.Fatalf("SendCurrency after resuming trading: %v", err)
+	}
+}
+
+func TestSendAllCurrencyKeepsMinimumBalance(t *testing.T) {
+	tests := []struct {
+		name       string
+		minBalance float64
+		wantSent   float64
+		wantErr    error
+	}{
+		{"no minimum", 0, 1000, nil},
+		{"minimum below the balance", 100, 900, nil},
+		{"minimum equal to the balance", 1000, 0, ErrNoHoldings},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := newTestClient(t, PostgreSettings{})
+			ctx := context.Background()
+			mustExec(t, pc, "UPDATE currencies SET min_balance = $1 WHERE currency = 'USD'", tt.minBalance)
+
+			seller := newTestUser(t, pc)
+			buyer := newTestUser(t, pc)
+
+			sent, err := pc.SendAllCurrency(ctx, seller, buyer, "usd")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SendAllCurrency: got %v, want %v", err, tt.wantErr)
+			}
+
+			if sent != tt.wantSent {
+				t.Fatalf("SendAllCurrency sent %v, want %v", sent, tt.wantSent)
+			}
+
+			if got, want := balance(t, pc, seller, "USD"), 1000-tt.wantSent; got != want {
+				t.Fatalf("seller has %v USD, want %v", got, want)
+			}
+
+			if got, want := balance(t, pc, buyer, "USD"), 1000+tt.wantSent; got != want {
+				t.Fatalf("buyer has %v USD, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetUserTradeCount(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	alice := newTestUser(t, pc)
+	bob := newTestUser(t, pc)
+	carol := newTestUser(t, pc)
+	dave := newTestUser(t, pc)
+
+	trades := []struct {
+		sellerID uint64
+		buyerID  uint64
+	}{
+		{alice, bob},
+		{alice, bob},
+		{bob, alice},
+		{carol, bob},
+	}
+
+	for _, trade := range trades {
+		err := pc.SendCurrency(trade.sellerID, trade.buyerID, "USD", 10)
+		if err != nil {
+			t.Fatalf("SendCurrency(%v, %v): %v", trade.sellerID, trade.buyerID, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		userID uint64
+		want   int
+	}{
+		{"sent and received", alice, 3},
+		{"mostly received", bob, 4},
+		{"sent only", carol, 1},
+		{"no trades", dave, 0},
+	}
+
+	for _, tt := range tests {
+		got, err := pc.GetUserTradeCount(ctx, tt.userID)
+		if err != nil {
+			t.Fatalf("GetUserTradeCount(%v): %v", tt.userID, err)
+		}
+
+		if got != tt.want {
+			t.Errorf("%v: GetUserTradeCount() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// txQuerier runs every query of the handler within tx.
+// Transactions the handler begins become savepoints of tx; their options are ignored.
+type txQuerier struct {
+	pgx.Tx
+}
+
+func (tq txQuerier) BeginTx(ctx context.Context, _ pgx.TxOptions) (pgx.Tx, error) {
+	return tq.Tx.Begin(ctx)
+}
+
+// withinTx returns a handler that runs every query within tx. Closing it does not close pc.
+// It does not use the currency cache, so it always sees the rates of tx.
+func (pc *postgresClient) withinTx(tx pgx.Tx) *postgresClient {
+	return &postgresClient{
+		settings:   pc.settings,
+		connection: txQuerier{Tx: tx},
+		currencies: newCurrencyCache(0),
+		connInfo:   pc.connInfo,
+		close:      func() {},
+	}
+}
+
+// Tx is a handler whose calls run in a single transaction until Commit or Rollback; it is unusable afterwards.
+// Begin of a Tx starts a nested transaction (a savepoint).
+// A failed call leaves the transaction aborted, so the only reasonable next step is Rollback.
+// Close rolls the transaction back unless it was already finished.
+type Tx interface {
+	PostgresHandler
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+type handlerTx struct {
+	*postgresClient
+	tx     pgx.Tx
+	parent *postgresClient
+}
+
+func (ht handlerTx) Commit(ctx context.Context) error {
+	atomic.StoreInt32(&ht.closed, 1)
+
+	err := ht.tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit transaction; err: %w", err)
+	}
+
+	// the transaction may have changed the rates cached by the parent handler
+	ht.parent.currencies.invalidate(ht.parent.tenant(ctx))
+
+	return nil
+}
+
+func (ht handlerTx) Rollback(ctx context.Context) error {
+	atomic.StoreInt32(&ht.closed, 1)
+
+	err := ht.tx.Rollback(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot rollback transaction; err: %w", err)
+	}
+
+	return nil
+}
+
+func (ht handlerTx) Close() {
+	if atomic.CompareAndSwapInt32(&ht.closed, 0, 1) {
+		ht.tx.Rollback(context.Background())
+	}
+}
+
+// Begin starts a transaction and returns a handler running all its calls within it.
+// Writes of the handler become visible to others only after Commit.
+func (pc *postgresClient) Begin(ctx context.Context) (Tx, error) {
+	if err := pc.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	tx, err := pc.connection.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction; err %v", err)
+	}
+
+	return handlerTx{postgresClient: pc.withinTx(tx), tx: tx, parent: pc}, nil
+}
+
+// WithReadOnlyTx calls fn with a handler whose queries run in a single read only transaction,
+// so all of them see the same snapshot and any write fails at the database level.
+// All the Get*, Find*, Search*, Stream* and Count* methods are safe to call within it;
+// writes fail with SQLSTATE 25006. Methods that begin their own transaction run within a savepoint
+// that is rolled back on the failure, so the following calls of fn still work; a failed write that is not
+// wrapped in a transaction (such as UpdateCurrency) leaves the transaction aborted, so the following calls fail as well.
+// The transaction is committed if fn returns nil and rolled back otherwise; the error of fn is returned as is.
+func (pc *postgresClient) WithReadOnlyTx(ctx context.Context, fn func(h PostgresHandler) error) error {
+	if err := pc.checkClosed(); err != nil {
+		return err
+	}
+
+	tx, err := pc.connection.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("cannot start read only transaction; err %v", err)
+	}
+
+	err = fn(pc.withinTx(tx))
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot commit read only transaction; err: %v", err)
+	}
+
+	return nil
+}
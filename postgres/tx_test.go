@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWithReadOnlyTxSurvivesFailedWrites(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	seller := newTestUser(t, pc)
+	buyer := newTestUser(t, pc)
+
+	err := pc.WithReadOnlyTx(ctx, func(h PostgresHandler) error {
+		// SendCurrency begins its own transaction, i.e. a savepoint rolled back on the failure
+		if err := h.SendCurrency(seller, buyer, "USD", 1); err == nil {
+			t.Errorf("SendCurrency succeeded in a read only transaction")
+		}
+
+		if _, err := h.GetCurrencyValue("USD"); err != nil {
+			t.Errorf("GetCurrencyValue after the failed SendCurrency: %v", err)
+		}
+
+		// UpdateCurrency writes without a transaction of its own, so it aborts the whole transaction
+		if err := h.UpdateCurrency("USD", 2); err == nil {
+			t.Errorf("UpdateCurrency succeeded in a read only transaction")
+		}
+
+		if _, err := h.GetCurrencyValue("USD"); err == nil {
+			t.Errorf("GetCurrencyValue succeeded in an aborted transaction")
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		t.Fatalf("WithReadOnlyTx committed an aborted transaction")
+	}
+
+	if got := balance(t, pc, seller, "USD"); got != 1000 {
+		t.Fatalf("seller has %v USD, want 1000", got)
+	}
+}
+
+func TestWithReadOnlyTxRunsSeveralStreams(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	userID := newTestUser(t, pc)
+
+	err := pc.WithReadOnlyTx(ctx, func(h PostgresHandler) error {
+		for i := 0; i < 2; i++ {
+			balances := 0
+			err := h.StreamBalances(ctx, func(balance Balance) error {
+				balances++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("StreamBalances #%v: %v", i+1, err)
+			}
+
+			if balances == 0 {
+				t.Fatalf("StreamBalances #%v returned no balances", i+1)
+			}
+		}
+
+		holders := []uint64{}
+		err := h.StreamCurrencyHolders(ctx, "USD", func(id uint64) error {
+			holders = append(holders, id)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("StreamCurrencyHolders after StreamBalances: %v", err)
+		}
+
+		for _, id := range holders {
+			if id == userID {
+				return nil
+			}
+		}
+
+		t.Fatalf("StreamCurrencyHolders(USD) = %v, want user %v among them", holders, userID)
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("WithReadOnlyTx: %v", err)
+	}
+}
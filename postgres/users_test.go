@@ -0,0 +1,513 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestListUsersAfterWalksAllPages(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		newTestUser(t, pc)
+	}
+
+	usersNum, err := pc.GetUsersNum()
+	if err != nil {
+		t.Fatalf("GetUsersNum: %v", err)
+	}
+
+	seen := map[uint64]bool{}
+	afterID := uint64(0)
+	pages := 0
+	for {
+		page, err := pc.ListUsersAfter(ctx, afterID, 2)
+		if err != nil {
+			t.Fatalf("ListUsersAfter(%v): %v", afterID, err)
+		}
+
+		if len(page) == 0 {
+			break
+		}
+
+		pages++
+		if len(page) > 2 {
+			t.Fatalf("page %v has %v users, limit is 2", pages, len(page))
+		}
+
+		for _, user := range page {
+			if user.ID <= afterID {
+				t.Fatalf("user %v returned after id %v", user.ID, afterID)
+			}
+
+			if seen[user.ID] {
+				t.Fatalf("user %v returned twice", user.ID)
+			}
+
+			seen[user.ID] = true
+		}
+
+		afterID = page[len(page)-1].ID
+	}
+
+	if len(seen) != usersNum {
+		t.Fatalf("walked %v users in %v pages, want %v", len(seen), pages, usersNum)
+	}
+}
+
+func TestFindSellerIsDeterministic(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+
+	first := newTestUser(t, pc)
+	newTestUser(t, pc)
+	newTestUser(t, pc)
+
+	for i := 0; i < 5; i++ {
+		sellerID, err := pc.FindSeller("USD", 500)
+		if err != nil {
+			t.Fatalf("FindSeller: %v", err)
+		}
+
+		if sellerID != first {
+			t.Fatalf("call %v returned seller %v, want the eligible seller with the lowest id %v", i, sellerID, first)
+		}
+	}
+}
+
+func TestGetUserCurrencyCount(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{SignupBonus: map[string]float64{"EUR": 5}})
+	ctx := context.Background()
+
+	userID := newTestUser(t, pc)
+
+	count, err := pc.GetUserCurrencyCount(ctx, userID)
+	if err != nil || count != 2 {
+		t.Fatalf("new user: got %v, %v; want 2 (start money and bonus)", count, err)
+	}
+
+	_, err = pc.ZeroUserBalances(ctx, userID)
+	if err != nil {
+		t.Fatalf("ZeroUserBalances: %v", err)
+	}
+
+	count, err = pc.GetUserCurrencyCount(ctx, userID)
+	if err != nil || count != 0 {
+		t.Fatalf("user with zero balances: got %v, %v; want 0", count, err)
+	}
+
+	count, err = pc.GetUserCurrencyCount(ctx, 1<<30)
+	if err != nil || count != 0 {
+		t.Fatalf("unknown user: got %v, %v; want 0", count, err)
+	}
+}
+
+func TestSearchUsersByEmailTreatsWildcardsLiterally(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	underscored, err := pc.RegisterUser(ctx, "first_last@example.com", "hash")
+	if err != nil {
+		t.Fatalf("RegisterUser: %v", err)
+	}
+
+	_, err = pc.RegisterUser(ctx, "firstXlast@example.com", "hash")
+	if err != nil {
+		t.Fatalf("RegisterUser: %v", err)
+	}
+
+	users, err := pc.SearchUsersByEmail(ctx, "FIRST_LAST", 10)
+	if err != nil {
+		t.Fatalf("SearchUsersByEmail: %v", err)
+	}
+
+	if len(users) != 1 || users[0].ID != underscored {
+		t.Fatalf("got %v, want only the user with the underscore (id %v)", users, underscored)
+	}
+
+	users, err = pc.SearchUsersByEmail(ctx, "%", 10)
+	if err != nil || len(users) != 0 {
+		t.Fatalf("searching %%: got %v, %v; want no users", users, err)
+	}
+}
+
+func TestGetUserCurrencyAmountDefault(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	userID := newTestUser(t, pc)
+
+	tests := []struct {
+		currency      string
+		defaultAmount float64
+		want          float64
+	}{
+		{currency: "USD", defaultAmount: 0, want: 1000},
+		{currency: "USD", defaultAmount: -1, want: 1000},
+		{currency: "EUR", defaultAmount: 0, want: 0},
+		{currency: "EUR", defaultAmount: -1, want: -1},
+	}
+
+	for _, tt := range tests {
+		got, err := pc.GetUserCurrencyAmount(ctx, userID, tt.currency, tt.defaultAmount)
+		if err != nil || got != tt.want {
+			t.Errorf("GetUserCurrencyAmount(%v, default %v): got %v, %v; want %v", tt.currency, tt.defaultAmount, got, err, tt.want)
+		}
+	}
+}
+
+func TestMergedUserIsHidden(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	sourceID := newTestUser(t, pc)
+	targetID := newTestUser(t, pc)
+	senderID := newTestUser(t, pc)
+
+	email := ""
+	err := pc.connection.QueryRow(ctx, "SELECT email FROM users WHERE id = $1", sourceID).Scan(&email)
+	if err != nil {
+		t.Fatalf("cannot get email of user %v: %v", sourceID, err)
+	}
+
+	err = pc.MergeUsers(ctx, sourceID, targetID)
+	if err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+
+	users, err := pc.ListUsersAfter(ctx, 0, 100)
+	if err != nil {
+		t.Fatalf("ListUsersAfter: %v", err)
+	}
+
+	for _, user := range users {
+		if user.ID == sourceID {
+			t.Fatalf("ListUsersAfter returned the merged user %v", sourceID)
+		}
+	}
+
+	found, err := pc.SearchUsersByEmail(ctx, email, 10)
+	if err != nil {
+		t.Fatalf("SearchUsersByEmail: %v", err)
+	}
+
+	if len(found) != 0 {
+		t.Fatalf("SearchUsersByEmail(%q) = %v, want no users", email, found)
+	}
+
+	withoutEUR, err := pc.GetUsersWithoutCurrency(ctx, "EUR", 100)
+	if err != nil {
+		t.Fatalf("GetUsersWithoutCurrency: %v", err)
+	}
+
+	for _, id := range withoutEUR {
+		if id == sourceID {
+			t.Fatalf("GetUsersWithoutCurrency returned the merged user %v", sourceID)
+		}
+	}
+
+	_, _, err = pc.GetUserRank(ctx, sourceID)
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("GetUserRank of the merged user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	err = pc.SendCurrencyByEmail(ctx, senderID, email, "USD", 1)
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("SendCurrencyByEmail to the merged user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	err = pc.SendCurrency(senderID, sourceID, "USD", 1)
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("SendCurrency to the merged user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	if got := balance(t, pc, senderID, "USD"); got != 1000 {
+		t.Fatalf("sender has %v USD after sending to the merged user, want 1000", got)
+	}
+
+	exists, err := pc.EmailExists(ctx, email)
+	if err != nil {
+		t.Fatalf("EmailExists: %v", err)
+	}
+
+	if exists {
+		t.Fatalf("EmailExists(%q) = true for the merged user", email)
+	}
+
+	newID, err := pc.RegisterUser(ctx, email, "hash")
+	if err != nil {
+		t.Fatalf("cannot register the email of the merged user: %v", err)
+	}
+
+	if newID == sourceID {
+		t.Fatalf("RegisterUser returned the merged user's id %v", sourceID)
+	}
+
+	_, err = pc.RegisterUser(ctx, email, "hash")
+	if !errors.Is(err, ErrUserExists) {
+		t.Fatalf("second RegisterUser(%q): got %v, want %v", email, err, ErrUserExists)
+	}
+}
+
+func TestRegisterUserRollsBackOnFailedBonus(t *testing.T) {
+	// users_money.currency is VARCHAR(255), so crediting the bonus fails after the user is inserted
+	pc := newTestClient(t, PostgreSettings{SignupBonus: map[string]float64{strings.Repeat("X", 300): 5}})
+	ctx := context.Background()
+
+	usersNum, err := pc.GetUsersNum()
+	if err != nil {
+		t.Fatalf("GetUsersNum: %v", err)
+	}
+
+	email := "bonus@example.com"
+	_, err = pc.RegisterUser(ctx, email, "hash")
+	if err == nil {
+		t.Fatalf("RegisterUser succeeded with a bonus that cannot be credited")
+	}
+
+	exists, err := pc.EmailExists(ctx, email)
+	if err != nil {
+		t.Fatalf("EmailExists: %v", err)
+	}
+
+	if exists {
+		t.Fatalf("user %q exists after the failed registration", email)
+	}
+
+	got, err := pc.GetUsersNum()
+	if err != nil {
+		t.Fatalf("GetUsersNum: %v", err)
+	}
+
+	if got != usersNum {
+		t.Fatalf("GetUsersNum() = %v after the failed registration, want %v", got, usersNum)
+	}
+}
+
+func TestMergeUsersKeepsReservations(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	sourceID := newTestUser(t, pc)
+	targetID := newTestUser(t, pc)
+
+	mustExec(t, pc, "UPDATE users_money SET reserved = 300 WHERE user_id = $1 AND currency = 'USD'", sourceID)
+	mustExec(t, pc, "UPDATE users_money SET reserved = 200 WHERE user_id = $1 AND currency = 'USD'", targetID)
+	mustExec(t, pc, "INSERT INTO users_money (user_id, currency, amount, reserved) VALUES ($1, 'EUR', 50, 20)", sourceID)
+
+	err := pc.MergeUsers(ctx, sourceID, targetID)
+	if err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+
+	tests := []struct {
+		currency     string
+		wantAmount   float64
+		wantReserved float64
+	}{
+		{"USD", 2000, 500},
+		{"EUR", 50, 20},
+	}
+
+	for _, tt := range tests {
+		amount, reserved := float64(0), float64(0)
+		err = pc.connection.QueryRow(
+			ctx,
+			"SELECT amount, reserved FROM users_money WHERE user_id = $1 AND currency = $2",
+			targetID,
+			tt.currency,
+		).Scan(&amount, &reserved)
+		if err != nil {
+			t.Fatalf("cannot get %v of the target user: %v", tt.currency, err)
+		}
+
+		if amount != tt.wantAmount || reserved != tt.wantReserved {
+			t.Errorf("target has %v %v with %v reserved, want %v with %v reserved", amount, tt.currency, reserved, tt.wantAmount, tt.wantReserved)
+		}
+	}
+}
+
+func TestZeroUserBalances(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	userID := newTestUser(t, pc)
+	otherID := newTestUser(t, pc)
+	mustExec(t, pc, "INSERT INTO users_money (user_id, currency, amount) VALUES ($1, 'EUR', 5), ($1, 'JPY', 0)", userID)
+
+	// the JPY balance is zero already, so only USD and EUR are wiped
+	affected, err := pc.ZeroUserBalances(ctx, userID)
+	if err != nil {
+		t.Fatalf("ZeroUserBalances: %v", err)
+	}
+
+	if affected != 2 {
+		t.Fatalf("ZeroUserBalances() = %v, want 2", affected)
+	}
+
+	nonZero := 0
+	err = pc.connection.QueryRow(ctx, "SELECT COUNT(*) FROM users_money WHERE user_id = $1 AND amount <> 0", userID).Scan(&nonZero)
+	if err != nil {
+		t.Fatalf("cannot count balances: %v", err)
+	}
+
+	if nonZero != 0 {
+		t.Fatalf("%v balances are not zero after ZeroUserBalances", nonZero)
+	}
+
+	rows, err := pc.connection.Query(
+		ctx,
+		"SELECT currency, amount FROM ledger WHERE operation = $1 AND seller_id = $2",
+		LedgerOperationWipe,
+		userID,
+	)
+	if err != nil {
+		t.Fatalf("cannot get wipes: %v", err)
+	}
+
+	defer rows.Close()
+
+	wipes := map[string]float64{}
+	for rows.Next() {
+		currency, amount := "", float64(0)
+		if err := rows.Scan(&currency, &amount); err != nil {
+			t.Fatalf("cannot scan wipe: %v", err)
+		}
+
+		if _, ok := wipes[currency]; ok {
+			t.Fatalf("%v was wiped twice", currency)
+		}
+
+		wipes[currency] = amount
+	}
+
+	if rows.Err() != nil {
+		t.Fatalf("cannot get wipes: %v", rows.Err())
+	}
+
+	if len(wipes) != 2 || wipes["USD"] != 1000 || wipes["EUR"] != 5 {
+		t.Fatalf("wipes = %v, want USD 1000 and EUR 5", wipes)
+	}
+
+	if got := balance(t, pc, otherID, "USD"); got != 1000 {
+		t.Fatalf("other user has %v USD, want 1000", got)
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{})
+	ctx := context.Background()
+
+	// a hash of the outdated algorithm as the server stored it before the migration
+	oldHash := "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+	newHash := "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA"
+
+	userID, err := pc.RegisterUser(ctx, "rehash@example.com", oldHash)
+	if err != nil {
+		t.Fatalf("RegisterUser: %v", err)
+	}
+
+	_, hash, err := pc.GetAuthRecord(ctx, "rehash@example.com")
+	if err != nil {
+		t.Fatalf("GetAuthRecord: %v", err)
+	}
+
+	err = pc.RehashPassword(ctx, userID, hash, newHash)
+	if err != nil {
+		t.Fatalf("RehashPassword: %v", err)
+	}
+
+	_, hash, err = pc.GetAuthRecord(ctx, "rehash@example.com")
+	if err != nil {
+		t.Fatalf("GetAuthRecord: %v", err)
+	}
+
+	if hash != newHash {
+		t.Fatalf("hash after RehashPassword = %q, want %q", hash, newHash)
+	}
+
+	// a second sign-in that read the outdated hash before the first one rehashed it must not overwrite the new hash
+	err = pc.RehashPassword(ctx, userID, oldHash, "$argon2id$stale")
+	if !errors.Is(err, ErrPasswordChanged) {
+		t.Fatalf("RehashPassword with a stale hash: got %v, want %v", err, ErrPasswordChanged)
+	}
+
+	_, hash, err = pc.GetAuthRecord(ctx, "rehash@example.com")
+	if err != nil {
+		t.Fatalf("GetAuthRecord: %v", err)
+	}
+
+	if hash != newHash {
+		t.Fatalf("hash after a stale RehashPassword = %q, want %q", hash, newHash)
+	}
+}
+
+func TestGetUserActivityCoversAllBalanceChanges(t *testing.T) {
+	pc := newTestClient(t, PostgreSettings{SignupBonus: map[string]float64{"EUR": 5}, FeePercent: 10})
+	ctx := context.Background()
+
+	userID := newTestUser(t, pc)
+	buyerID := newTestUser(t, pc)
+	pc.settings.FeeAccountID = newTestUser(t, pc)
+
+	err := pc.SendCurrencyWithFee(ctx, userID, buyerID, "USD", 100)
+	if err != nil {
+		t.Fatalf("SendCurrencyWithFee: %v", err)
+	}
+
+	_, err = pc.CreditAllHolders(ctx, "USD", 10)
+	if err != nil {
+		t.Fatalf("CreditAllHolders: %v", err)
+	}
+
+	_, err = pc.ZeroUserBalances(ctx, userID)
+	if err != nil {
+		t.Fatalf("ZeroUserBalances: %v", err)
+	}
+
+	entries, err := pc.GetUserActivity(ctx, userID, 0)
+	if err != nil {
+		t.Fatalf("GetUserActivity: %v", err)
+	}
+
+	operations := map[string]int{}
+	sums := map[string]float64{}
+	for i, entry := range entries {
+		if i > 0 && entry.ID >= entries[i-1].ID {
+			t.Fatalf("entry %v is listed after the older entry %v", entry.ID, entries[i-1].ID)
+		}
+
+		operations[entry.Operation]++
+		sums[entry.Currency] += entry.Amount
+	}
+
+	wantOperations := map[string]int{
+		LedgerOperationBonus:  1,
+		LedgerOperationTrade:  1,
+		LedgerOperationFee:    1,
+		LedgerOperationCredit: 1,
+		LedgerOperationWipe:   2,
+	}
+
+	for operation, want := range wantOperations {
+		if operations[operation] != want {
+			t.Errorf("%v %v entries, want %v; all entries: %v", operations[operation], operation, want, entries)
+		}
+	}
+
+	// the initial 1000 USD of a new user is not written to the ledger
+	if sums["USD"] != -1000 || sums["EUR"] != 0 {
+		t.Errorf("activity sums up to %v USD and %v EUR, want -1000 and 0", sums["USD"], sums["EUR"])
+	}
+
+	latest, err := pc.GetUserActivity(ctx, userID, 2)
+	if err != nil {
+		t.Fatalf("GetUserActivity with limit: %v", err)
+	}
+
+	if len(latest) != 2 || latest[0].Operation != LedgerOperationWipe || latest[1].Operation != LedgerOperationWipe {
+		t.Fatalf("GetUserActivity(limit 2) = %v, want the two wipes", latest)
+	}
+}
@@ -0,0 +1,46 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+)
+
+// requireNotBlank returns ErrInvalidArgument if the value is empty or consists of whitespaces only
+func requireNotBlank(name, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("%w; %v must not be empty", ErrInvalidArgument, name)
+	}
+
+	return nil
+}
+
+// normalizeCurrency brings the currency code to the form it is stored in, e.g. " btc" -> "BTC"
+func normalizeCurrency(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+// normalizeHost strips the scheme and trailing slashes from the host, e.g. "http://db:5432/" -> "db:5432".
+// Returns ErrInvalidArgument if what is left cannot be a host.
+func normalizeHost(host string) (string, error) {
+	normalized := strings.TrimSpace(host)
+	if i := strings.Index(normalized, "://"); i >= 0 {
+		normalized = normalized[i+len("://"):]
+	}
+
+	normalized = strings.TrimRight(normalized, "/")
+
+	if normalized == "" || strings.ContainsAny(normalized, "/@?# \t") {
+		return "", fmt.Errorf("%w; invalid host %q", ErrInvalidArgument, host)
+	}
+
+	return normalized, nil
+}
+
+// requireDifferentUsers returns ErrSelfTransfer if the seller and the buyer are the same user
+func requireDifferentUsers(sellerID, buyerID uint64) error {
+	if sellerID == buyerID {
+		return fmt.Errorf("%w; user id %v", ErrSelfTransfer, sellerID)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBlankArgumentsAreRejected(t *testing.T) {
+	// no connection: the arguments must be rejected before any query
+	pc := &postgresClient{}
+
+	calls := map[string]func(arg string) error{
+		"GetCurrencyAmount": func(currency string) error {
+			_, err := pc.GetCurrencyAmount(currency)
+			return err
+		},
+		"GetCurrencyValue": func(currency string) error {
+			_, err := pc.GetCurrencyValue(currency)
+			return err
+		},
+		"UpdateCurrency": func(currency string) error {
+			return pc.UpdateCurrency(currency, 1)
+		},
+		"GetUserData": func(email string) error {
+			_, _, err := pc.GetUserData(email)
+			return err
+		},
+		"FindSeller": func(currency string) error {
+			_, err := pc.FindSeller(currency, 1)
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		for _, arg := range []string{"", " ", "\t\n"} {
+			if err := call(arg); !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("%v(%q): got %v, want ErrInvalidArgument", name, arg, err)
+			}
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "alice", want: "alice"},
+		{value: "first_last", want: `first\_last`},
+		{value: "100%", want: `100\%`},
+		{value: `back\slash`, want: `back\\slash`},
+		{value: `%_\`, want: `\%\_\\`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeLike(tt.value); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "localhost:5432", want: "localhost:5432"},
+		{host: "  db.example.com  ", want: "db.example.com"},
+		{host: "postgres://db:5432", want: "db:5432"},
+		{host: "postgresql://db:5432/", want: "db:5432"},
+		{host: "db//", want: "db"},
+		{host: "[::1]:5432", want: "[::1]:5432"},
+		{host: "", wantErr: true},
+		{host: "   ", wantErr: true},
+		{host: "postgres://", wantErr: true},
+		{host: "db:5432/exchange", wantErr: true},
+		{host: "user@db", wantErr: true},
+		{host: "db?sslmode=disable", wantErr: true},
+		{host: "db#fragment", wantErr: true},
+		{host: "db host", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeHost(tt.host)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("normalizeHost(%q): got %q, %v; want ErrInvalidArgument", tt.host, got, err)
+			}
+
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, %v; want %q", tt.host, got, err, tt.want)
+		}
+	}
+}
+
+func TestRequireDifferentUsers(t *testing.T) {
+	tests := []struct {
+		sellerID uint64
+		buyerID  uint64
+		wantErr  error
+	}{
+		{sellerID: 1, buyerID: 2, wantErr: nil},
+		{sellerID: 2, buyerID: 1, wantErr: nil},
+		{sellerID: 0, buyerID: 1, wantErr: nil},
+		{sellerID: 1, buyerID: 1, wantErr: ErrSelfTransfer},
+		{sellerID: 0, buyerID: 0, wantErr: ErrSelfTransfer},
+	}
+
+	for _, tt := range tests {
+		if err := requireDifferentUsers(tt.sellerID, tt.buyerID); !errors.Is(err, tt.wantErr) {
+			t.Errorf("requireDifferentUsers(%v, %v) = %v, want %v", tt.sellerID, tt.buyerID, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSelfTransfersAreRejected(t *testing.T) {
+	// no connection: the transfer must be rejected before any transaction starts
+	pc := &postgresClient{}
+	ctx := context.Background()
+
+	calls := map[string]func(userID uint64) error{
+		"SendCurrency": func(userID uint64) error {
+			return pc.SendCurrency(userID, userID, "USD", 1)
+		},
+		"SendCurrencyWithFee": func(userID uint64) error {
+			return pc.SendCurrencyWithFee(ctx, userID, userID, "USD", 1)
+		},
+		"SendCurrencies": func(userID uint64) error {
+			return pc.SendCurrencies(ctx, userID, userID, map[string]float64{"USD": 1})
+		},
+		"SendAllCurrency": func(userID uint64) error {
+			_, err := pc.SendAllCurrency(ctx, userID, userID, "USD")
+			return err
+		},
+		"SendCurrencyIfRate": func(userID uint64) error {
+			return pc.SendCurrencyIfRate(ctx, userID, userID, "USD", 1, 2)
+		},
+		"Barter": func(userID uint64) error {
+			return pc.Barter(ctx, userID, userID, "USD", 1, "EUR", 1)
+		},
+	}
+
+	for name, call := range calls {
+		for _, userID := range []uint64{0, 1, 42} {
+			if err := call(userID); !errors.Is(err, ErrSelfTransfer) {
+				t.Errorf("%v(%v, %v): got %v, want ErrSelfTransfer", name, userID, userID, err)
+			}
+		}
+	}
+}
+
+func TestNegativeAmountsAreRejected(t *testing.T) {
+	// no connection: the amounts must be rejected before any query
+	pc := &postgresClient{}
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		"AdminSetBalance": func() error {
+			return pc.AdminSetBalance(ctx, 1, 2, "USD", -1, "correction")
+		},
+		"LaunchCurrency": func() error {
+			return pc.LaunchCurrency(ctx, "NEW", 1, map[uint64]float64{1: 100, 2: -1})
+		},
+	}
+
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%v: got %v, want ErrInvalidArgument", name, err)
+		}
+	}
+}